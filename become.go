@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Privilege escalation methods for become_method.
+const (
+	becomeSudo = "sudo"
+	becomeDoas = "doas"
+	becomeSu   = "su"
+)
+
+// become runs a command as another user.
+type become struct {
+	Method   string // sudo, doas or su
+	User     string // target user, root if empty
+	Password string // fed to sudo on stdin, empty for none
+
+	// marker tags sudo's password prompt and the start of the command
+	// on stderr, so the password is only sent when asked for
+	marker string
+}
+
+func validBecomeMethod(method string) error {
+	switch method {
+	case "", becomeSudo, becomeDoas, becomeSu:
+		return nil
+	}
+	return fmt.Errorf("unknown become_method %q (use %s, %s or %s)", method, becomeSudo, becomeDoas, becomeSu)
+}
+
+// becomeFor returns how step escalates privileges, nil if it runs as the
+// login user. Step settings override the task's.
+func (t Task) becomeFor(step Step) *become {
+	on := t.Become
+	if step.Become != nil {
+		on = *step.Become
+	}
+	if !on {
+		return nil
+	}
+	return &become{
+		Method: cmp.Or(step.BecomeMethod, t.BecomeMethod, becomeSudo),
+		User:   cmp.Or(step.BecomeUser, t.BecomeUser),
+	}
+}
+
+// wrap returns command run through the become method. Without a tty
+// there is no one to answer a prompt, so sudo and doas are told not to
+// ask unless sudo gets the password on stdin; su always needs a tty for
+// its password, unless run as root. With a password, sudo prompts with
+// the marker and the command announces its start on stderr, for the
+// passwordFeeder.
+func (b become) wrap(command string, tty bool) string {
+	var args []string
+	switch b.Method {
+	case becomeDoas:
+		args = append(args, "doas")
+		if !tty {
+			args = append(args, "-n")
+		}
+		if b.User != "" {
+			args = append(args, "-u", shellQuote(b.User))
+		}
+		args = append(args, "sh", "-c")
+	case becomeSu:
+		args = append(args, "su", shellQuote(cmp.Or(b.User, "root")), "-c")
+	default:
+		args = append(args, "sudo")
+		switch {
+		case b.feedsPassword(tty):
+			args = append(args, "-S", "-p", shellQuote(b.promptMarker()))
+			command = fmt.Sprintf("echo %s >&2; %s", shellQuote(b.readyMarker()), command)
+		case !tty:
+			args = append(args, "-n")
+		}
+		if b.User != "" {
+			args = append(args, "-u", shellQuote(b.User))
+		}
+		args = append(args, "--", "sh", "-c")
+	}
+	return strings.Join(args, " ") + " " + shellQuote(command)
+}
+
+// feedsPassword reports whether the password goes to sudo on stdin.
+func (b become) feedsPassword(tty bool) bool {
+	return b.Method == becomeSudo && b.Password != "" && !tty
+}
+
+// withMarker returns b with a new random marker.
+func (b become) withMarker() become {
+	b.marker = "gosctl-become-" + rand.Text()
+	return b
+}
+
+func (b become) promptMarker() string { return "[" + b.marker + "] password:" }
+func (b become) readyMarker() string  { return "[" + b.marker + "] ok" }
+
+// passwordFeeder sits between sudo and the command's stdin and stderr.
+// It sends the password only when sudo prompts for it, and the input
+// only once the command has started. So with NOPASSWD or cached
+// credentials the password never reaches the command, and sudo never
+// reads the input as a password: after a wrong one stdin is closed. The
+// markers are removed from stderr.
+type passwordFeeder struct {
+	b      become
+	stdin  io.WriteCloser
+	input  io.Reader
+	stderr io.Writer
+
+	mu        sync.Mutex
+	held      []byte // stderr not yet checked for markers
+	prompted  bool
+	started   bool
+	closeOnce sync.Once
+}
+
+func newPasswordFeeder(b become, stdin io.WriteCloser, input io.Reader, stderr io.Writer) *passwordFeeder {
+	if stderr == nil {
+		stderr = io.Discard
+	}
+	return &passwordFeeder{b: b, stdin: stdin, input: input, stderr: stderr}
+}
+
+// Write takes the session's stderr.
+func (f *passwordFeeder) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.started {
+		return f.stderr.Write(p)
+	}
+	prompt, ready := []byte(f.b.promptMarker()), []byte(f.b.readyMarker()+"\n")
+	f.held = append(f.held, p...)
+	for !f.started {
+		i, j := bytes.Index(f.held, prompt), bytes.Index(f.held, ready)
+		switch {
+		case i >= 0 && (j < 0 || i < j):
+			f.stderr.Write(f.held[:i])
+			f.held = f.held[i+len(prompt):]
+			if f.prompted {
+				// A wrong password; let sudo fail instead of trying the input
+				f.closeStdin()
+				continue
+			}
+			f.prompted = true
+			io.WriteString(f.stdin, f.b.Password+"\n")
+		case j >= 0:
+			f.stderr.Write(f.held[:j])
+			f.stderr.Write(f.held[j+len(ready):])
+			f.held = nil
+			f.started = true
+			go f.sendInput()
+		default:
+			// Hold back what could be the start of a marker
+			n := max(len(f.held)-len(prompt), 0)
+			f.stderr.Write(f.held[:n])
+			f.held = f.held[n:]
+			return len(p), nil
+		}
+	}
+	return len(p), nil
+}
+
+// flush writes out stderr still held back, when the command never
+// started.
+func (f *passwordFeeder) flush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stderr.Write(f.held)
+	f.held = nil
+}
+
+func (f *passwordFeeder) sendInput() {
+	if f.input != nil {
+		io.Copy(f.stdin, f.input)
+	}
+	f.closeStdin()
+}
+
+func (f *passwordFeeder) closeStdin() {
+	f.closeOnce.Do(func() { f.stdin.Close() })
+}
+
+// becomePassword returns the sudo password for the host: the prompted
+// one if set, otherwise the output of become_password_cmd, run once per
+// connection.
+func (c *SSHClient) becomePassword(prompted string) (string, error) {
+	if prompted != "" || c.host.BecomePasswordCmd == "" {
+		return prompted, nil
+	}
+	c.becomeOnce.Do(func() {
+		c.becomePass, c.becomeErr = runSecretCmd(c.host.BecomePasswordCmd)
+		if c.becomeErr != nil {
+			c.becomeErr = fmt.Errorf("become_password_cmd: %w", c.becomeErr)
+		}
+	})
+	return c.becomePass, c.becomeErr
+}
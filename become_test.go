@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/axelrhd/gosctl/internal/sshtest"
+)
+
+func TestBecomeWrap(t *testing.T) {
+	tests := []struct {
+		b    become
+		tty  bool
+		want string
+	}{
+		{become{Method: becomeSudo}, false, `sudo -n -- sh -c 'cd /app && id -u'`},
+		{become{Method: becomeSudo}, true, `sudo -- sh -c 'cd /app && id -u'`},
+		{become{Method: becomeSudo, User: "postgres", Password: "secret", marker: "M"}, false, `sudo -S -p '[M] password:' -u 'postgres' -- sh -c 'echo '\''[M] ok'\'' >&2; cd /app && id -u'`},
+		{become{Method: becomeDoas, User: "app"}, false, `doas -n -u 'app' sh -c 'cd /app && id -u'`},
+		{become{Method: becomeSu}, true, `su 'root' -c 'cd /app && id -u'`},
+	}
+	for _, tt := range tests {
+		if got := tt.b.wrap("cd /app && id -u", tt.tty); got != tt.want {
+			t.Errorf("%+v tty=%v:\n got  %s\n want %s", tt.b, tt.tty, got, tt.want)
+		}
+	}
+}
+
+func TestBecomeFor(t *testing.T) {
+	off := false
+	task := Task{Become: true, BecomeUser: "app"}
+
+	if b := task.becomeFor(Step{Run: "ls"}); b == nil || b.Method != becomeSudo || b.User != "app" {
+		t.Errorf("expected sudo as app, got %+v", b)
+	}
+	if b := task.becomeFor(Step{Run: "ls", BecomeUser: "postgres", BecomeMethod: becomeDoas}); b == nil || b.Method != becomeDoas || b.User != "postgres" {
+		t.Errorf("expected step to override user and method, got %+v", b)
+	}
+	if b := task.becomeFor(Step{Run: "ls", Become: &off}); b != nil {
+		t.Errorf("expected step to turn become off, got %+v", b)
+	}
+	if b := (Task{}).becomeFor(Step{Run: "ls"}); b != nil {
+		t.Errorf("expected no become by default, got %+v", b)
+	}
+
+	if err := (Step{Upload: "a", To: "/tmp/a", Become: &off}).Validate(); err == nil {
+		t.Error("expected error for become on an upload step")
+	}
+	if err := (Step{Run: "ls", BecomeMethod: "pbrun"}).Validate(); err == nil {
+		t.Error("expected error for unknown become_method")
+	}
+}
+
+// fakeSudo answers like sudo -S -p: it prompts on stderr unless nopasswd,
+// reads the password a byte at a time so it can't take the input, and
+// then cats the input.
+func fakeSudo(password string, nopasswd bool) sshtest.Handler {
+	markerRe := regexp.MustCompile(`gosctl-become-[A-Z2-7]+`)
+	return func(ctx context.Context, e sshtest.Exec, stdin io.Reader, stdout, stderr io.Writer) int {
+		b := become{marker: markerRe.FindString(e.Command)}
+		readLine := func() (string, bool) {
+			var line []byte
+			c := make([]byte, 1)
+			for {
+				if _, err := stdin.Read(c); err != nil {
+					return "", false
+				}
+				if c[0] == '\n' {
+					return string(line), true
+				}
+				line = append(line, c[0])
+			}
+		}
+		for tries := 0; !nopasswd; tries++ {
+			if tries > 0 {
+				io.WriteString(stderr, "Sorry, try again.\n")
+			}
+			io.WriteString(stderr, b.promptMarker())
+			line, ok := readLine()
+			if !ok {
+				io.WriteString(stderr, "sudo: no password was provided\n")
+				return 1
+			}
+			if line == password {
+				break
+			}
+		}
+		io.WriteString(stderr, b.readyMarker()+"\n")
+		io.Copy(stdout, stdin)
+		return 0
+	}
+}
+
+func TestRunStepBecomePassword(t *testing.T) {
+	needShell(t)
+	tests := []struct {
+		name        string
+		passwordCmd string
+		nopasswd    bool
+		status      int
+		stdout      string
+		stdin       string // as read by the server
+	}{
+		{"password", "echo hunter2", false, 0, "VACUUM;\n", "hunter2\nVACUUM;\n"},
+		{"nopasswd", "echo hunter2", true, 0, "VACUUM;\n", "VACUUM;\n"},
+		{"wrong password", "echo wrong", false, 1, "", "wrong\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := sshtest.NewServer(t, sshtest.Config{Password: "secret", Handler: fakeSudo("hunter2", tt.nopasswd)})
+			host := testHost(t, srv)
+			host.Password = "secret"
+			host.BecomePasswordCmd = tt.passwordCmd
+			host.Env = map[string]string{"APP_ENV": "production"}
+			client := connect(t, host)
+
+			task := Task{Workdir: "/app", Become: true}
+			step := Step{Run: "psql", Input: "VACUUM;\n"}
+			var stdout, stderr bytes.Buffer
+			err := runStep(context.Background(), client, "db", task, step, RunOptions{Stdout: &stdout, Stderr: &stderr})
+			if code := exitCode(err); (err == nil) != (tt.status == 0) || (err != nil && code != tt.status) {
+				t.Fatalf("expected exit status %d, got %v", tt.status, err)
+			}
+
+			e := srv.Execs()[0]
+			marker := regexp.MustCompile(`gosctl-become-[A-Z2-7]+`).FindString(e.Command)
+			want := `sudo -S -p '[M] password:' -- sh -c 'echo '\''[M] ok'\'' >&2; export APP_ENV='\''production'\''; cd /app && psql'`
+			if got := strings.ReplaceAll(e.Command, marker, "M"); marker == "" || got != want {
+				t.Errorf("unexpected command:\n got  %s\n want %s", e.Command, want)
+			}
+			if len(e.Env) != 0 {
+				t.Errorf("expected env inside the command, got env requests %v", e.Env)
+			}
+			if string(e.Stdin) != tt.stdin {
+				t.Errorf("expected stdin %q, got %q", tt.stdin, e.Stdin)
+			}
+			if stdout.String() != tt.stdout {
+				t.Errorf("expected output %q, got %q", tt.stdout, stdout.String())
+			}
+			if strings.Contains(stderr.String(), "gosctl-become-") {
+				t.Errorf("marker leaked into stderr: %q", stderr.String())
+			}
+		})
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestPasswordFeederSplitWrites(t *testing.T) {
+	b := become{Method: becomeSudo, Password: "hunter2"}.withMarker()
+	var stdin, stderr bytes.Buffer
+	f := newPasswordFeeder(b, nopWriteCloser{&stdin}, nil, &stderr)
+
+	// Markers split across writes, as the channel may deliver them
+	out := "lecture\n" + b.promptMarker() + b.readyMarker() + "\nwarning: x\n"
+	for i := range len(out) {
+		f.Write([]byte{out[i]})
+	}
+	f.flush()
+
+	if stdin.String() != "hunter2\n" {
+		t.Errorf("expected password once on stdin, got %q", stdin.String())
+	}
+	if stderr.String() != "lecture\nwarning: x\n" {
+		t.Errorf("expected stderr without markers, got %q", stderr.String())
+	}
+}
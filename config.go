@@ -2,19 +2,33 @@ package main
 
 import (
 	"fmt"
+	"maps"
+	"net"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/kevinburke/ssh_config"
+	"golang.org/x/crypto/ssh"
 )
 
 type Config struct {
-	Hosts map[string]Host `toml:"hosts"`
-	Tasks map[string]Task `toml:"tasks"`
+	Defaults Host              `toml:"defaults"`
+	Hosts    map[string]Host   `toml:"hosts"`
+	Tasks    map[string]Task   `toml:"tasks"`
+	Tunnels  map[string]Tunnel `toml:"tunnels"`
 
 	// Source tracking (not from TOML)
-	HostSources map[string]string `toml:"-"`
-	TaskSources map[string]string `toml:"-"`
+	HostSources   map[string]string `toml:"-"`
+	TaskSources   map[string]string `toml:"-"`
+	TunnelSources map[string]string `toml:"-"`
+
+	// OpenSSH client config used as a fallback for host settings
+	sshConfig *ssh_config.Config
 }
 
 type Host struct {
@@ -23,15 +37,231 @@ type Host struct {
 	User     string `toml:"user"`
 	KeyFile  string `toml:"key_file"`
 	Password string `toml:"password"`
+	Jump     string `toml:"jump"`
+
+	CertFile       string   `toml:"cert_file"`
+	IdentitiesOnly bool     `toml:"identities_only"`
+	PassphraseCmd  string   `toml:"passphrase_cmd"`
+	AuthMethods    []string `toml:"auth_methods"`
+	ForwardAgent   bool     `toml:"forward_agent"`
+	HostKeyPolicy  string   `toml:"host_key_policy"`
+	KnownHostsFile string   `toml:"known_hosts_file"`
+
+	// Connection handling; unset values use the built-in defaults
+	ConnectTimeout    duration `toml:"connect_timeout"`
+	KeepaliveInterval duration `toml:"keepalive_interval"`
+	ConnectRetries    int      `toml:"connect_retries"`
+	RetryBackoff      duration `toml:"retry_backoff"`
+
+	// Pinned host key, checked instead of known_hosts
+	HostKey            string `toml:"host_key"`
+	HostKeyFingerprint string `toml:"host_key_fingerprint"`
+
+	// Prints the sudo password for become, like passphrase_cmd
+	BecomePasswordCmd string `toml:"become_password_cmd"`
+
+	// Template variables for upload and template steps
+	Vars map[string]any `toml:"vars"`
+
+	// Environment variables for every command on the host
+	Env map[string]string `toml:"env"`
+
+	// Where values not set in sctl.toml came from, keyed by TOML name
+	Origins map[string]string `toml:"-"`
+}
+
+// duration is a time.Duration written as a string like "10s" in TOML. A
+// bare number is an error rather than a count of nanoseconds.
+type duration time.Duration
+
+func (d *duration) UnmarshalTOML(v any) error {
+	s, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("expected a duration string like \"10s\", got %v", v)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) String() string {
+	return time.Duration(d).String()
+}
+
+// inherit fills unset fields from the [defaults] section and returns the
+// TOML names of the fields it set.
+func (h *Host) inherit(d Host) []string {
+	var set []string
+	inheritField(&set, "user", &h.User, d.User)
+	inheritField(&set, "port", &h.Port, d.Port)
+	inheritField(&set, "key_file", &h.KeyFile, d.KeyFile)
+	inheritField(&set, "cert_file", &h.CertFile, d.CertFile)
+	inheritField(&set, "password", &h.Password, d.Password)
+	inheritField(&set, "jump", &h.Jump, d.Jump)
+	inheritField(&set, "identities_only", &h.IdentitiesOnly, d.IdentitiesOnly)
+	inheritField(&set, "passphrase_cmd", &h.PassphraseCmd, d.PassphraseCmd)
+	inheritField(&set, "forward_agent", &h.ForwardAgent, d.ForwardAgent)
+	inheritField(&set, "host_key_policy", &h.HostKeyPolicy, d.HostKeyPolicy)
+	inheritField(&set, "known_hosts_file", &h.KnownHostsFile, d.KnownHostsFile)
+	inheritField(&set, "connect_timeout", &h.ConnectTimeout, d.ConnectTimeout)
+	inheritField(&set, "keepalive_interval", &h.KeepaliveInterval, d.KeepaliveInterval)
+	inheritField(&set, "connect_retries", &h.ConnectRetries, d.ConnectRetries)
+	inheritField(&set, "retry_backoff", &h.RetryBackoff, d.RetryBackoff)
+	inheritField(&set, "become_password_cmd", &h.BecomePasswordCmd, d.BecomePasswordCmd)
+	if len(h.AuthMethods) == 0 && len(d.AuthMethods) > 0 {
+		h.AuthMethods = d.AuthMethods
+		set = append(set, "auth_methods")
+	}
+	if len(d.Vars) > 0 {
+		// Per variable, so hosts can override single defaults
+		h.Vars = mergeMaps(d.Vars, h.Vars)
+	}
+	if len(d.Env) > 0 {
+		h.Env = mergeMaps(d.Env, h.Env)
+	}
+	return set
+}
+
+func inheritField[T comparable](set *[]string, key string, dst *T, src T) {
+	var zero T
+	if *dst == zero && src != zero {
+		*dst = src
+		*set = append(*set, key)
+	}
+}
+
+// mergeMaps merges vars or env maps, later maps winning.
+func mergeMaps[V any](ms ...map[string]V) map[string]V {
+	merged := make(map[string]V)
+	for _, m := range ms {
+		maps.Copy(merged, m)
+	}
+	return merged
+}
+
+// Validate checks the host configuration for errors.
+func (h Host) Validate(name string) error {
+	if h.Address == "" {
+		return fmt.Errorf("host %q: missing address", name)
+	}
+	switch h.HostKeyPolicy {
+	case "", hostKeyStrict, hostKeyAcceptNew, hostKeyPrompt:
+	default:
+		return fmt.Errorf("host %q: unknown host_key_policy %q (use %s, %s or %s)",
+			name, h.HostKeyPolicy, hostKeyStrict, hostKeyAcceptNew, hostKeyPrompt)
+	}
+	for _, method := range h.AuthMethods {
+		switch method {
+		case authPublicKey, authPassword, authKeyboardInteractive:
+		default:
+			return fmt.Errorf("host %q: unknown auth method %q (use %s, %s or %s)",
+				name, method, authPublicKey, authPassword, authKeyboardInteractive)
+		}
+	}
+	if h.ConnectTimeout < 0 || h.RetryBackoff < 0 {
+		return fmt.Errorf("host %q: connect_timeout and retry_backoff must not be negative", name)
+	}
+	if h.ConnectRetries < 0 {
+		return fmt.Errorf("host %q: connect_retries must not be negative", name)
+	}
+	if err := validateEnv(h.Env); err != nil {
+		return fmt.Errorf("host %q: %v", name, err)
+	}
+	if h.HostKey != "" {
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(h.HostKey)); err != nil {
+			return fmt.Errorf("host %q: invalid host_key: %v", name, err)
+		}
+	}
+	if h.HostKeyFingerprint != "" && !strings.HasPrefix(h.HostKeyFingerprint, "SHA256:") {
+		return fmt.Errorf("host %q: host_key_fingerprint must be a SHA256:... fingerprint", name)
+	}
+	return nil
+}
+
+// validateEnv checks that env only has valid shell variable names, so
+// they can be exported safely.
+func validateEnv(env map[string]string) error {
+	for _, key := range slices.Sorted(maps.Keys(env)) {
+		if !validEnvName(key) {
+			return fmt.Errorf("invalid env name %q", key)
+		}
+	}
+	return nil
+}
+
+func validEnvName(name string) bool {
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		return false
+	}
+	for _, r := range name {
+		if r != '_' && !(r >= 'A' && r <= 'Z') && !(r >= 'a' && r <= 'z') && !(r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseEnvFlags parses -e flags. KEY=VAL sets a value; a bare KEY passes
+// on the local value.
+func parseEnvFlags(flags []string) (map[string]string, error) {
+	env := make(map[string]string)
+	for _, flag := range flags {
+		key, value, ok := strings.Cut(flag, "=")
+		if !validEnvName(key) {
+			return nil, fmt.Errorf("invalid env name %q", key)
+		}
+		if !ok {
+			if value, ok = os.LookupEnv(key); !ok {
+				return nil, fmt.Errorf("env %s is not set locally", key)
+			}
+		}
+		env[key] = value
+	}
+	return env, nil
+}
+
+// JumpHosts returns the jump host chain for this host, outermost first.
+// The chain is a comma-separated list of host names, like ssh -J.
+func (h Host) JumpHosts() []string {
+	var hops []string
+	for hop := range strings.SplitSeq(h.Jump, ",") {
+		if hop = strings.TrimSpace(hop); hop != "" {
+			hops = append(hops, hop)
+		}
+	}
+	return hops
 }
 
 type Task struct {
-	Host    string   `toml:"host"`
-	Hosts   []string `toml:"hosts"`
-	Workdir string   `toml:"workdir"`
-	Before  []string `toml:"before"`
-	Steps   []string `toml:"steps"`
-	After   []string `toml:"after"`
+	Host        string   `toml:"host"`
+	Hosts       []string `toml:"hosts"`
+	Workdir     string   `toml:"workdir"`
+	Before      []string `toml:"before"`
+	Steps       []Step   `toml:"steps"`
+	After       []string `toml:"after"`
+	Parallel    bool     `toml:"parallel"`
+	MaxParallel int      `toml:"max_parallel"`
+	TTY         bool     `toml:"tty"`
+
+	// ForwardAgent forwards the local SSH agent for the task's steps, in
+	// addition to hosts with forward_agent set
+	ForwardAgent bool `toml:"forward_agent"`
+
+	// Template variables and environment, overriding the host's
+	Vars map[string]any    `toml:"vars"`
+	Env  map[string]string `toml:"env"`
+
+	// Privilege escalation for run steps, see become
+	Become       bool   `toml:"become"`
+	BecomeUser   string `toml:"become_user"`
+	BecomeMethod string `toml:"become_method"`
+
+	// Sudo password from --ask-become-pass, overriding the hosts'
+	// become_password_cmd
+	becomePassword string
 }
 
 // GetHosts returns the target hosts for this task.
@@ -45,6 +275,21 @@ func (t Task) GetHosts() []string {
 	return nil
 }
 
+// Workers returns how many hosts the task may run on concurrently.
+// A positive override (from --parallel) takes precedence over the task config.
+func (t Task) Workers(hostCount, override int) int {
+	n := 1
+	switch {
+	case override > 0:
+		n = override
+	case t.MaxParallel > 0:
+		n = t.MaxParallel
+	case t.Parallel:
+		n = hostCount
+	}
+	return max(1, min(n, hostCount))
+}
+
 // Validate checks the task configuration for errors.
 func (t Task) Validate(name string) error {
 	if t.Host != "" && len(t.Hosts) > 0 {
@@ -56,6 +301,24 @@ func (t Task) Validate(name string) error {
 	if len(t.Steps) == 0 {
 		return fmt.Errorf("task %q: missing 'steps'", name)
 	}
+	if t.MaxParallel < 0 {
+		return fmt.Errorf("task %q: 'max_parallel' must not be negative", name)
+	}
+	if err := validateEnv(t.Env); err != nil {
+		return fmt.Errorf("task %q: %v", name, err)
+	}
+	if err := validBecomeMethod(t.BecomeMethod); err != nil {
+		return fmt.Errorf("task %q: %v", name, err)
+	}
+	for i, step := range t.Steps {
+		if err := step.Validate(); err != nil {
+			return fmt.Errorf("task %q: step %d: %v", name, i+1, err)
+		}
+		// A pty reads from the terminal, so there is no stdin to feed
+		if t.TTY && step.Input != "" {
+			return fmt.Errorf("task %q: step %d: 'input' can't be used with 'tty'", name, i+1)
+		}
+	}
 	return nil
 }
 
@@ -74,31 +337,208 @@ func (t Task) ValidateRefs(name string, tasks map[string]Task) error {
 	return nil
 }
 
+// Tunnel is a named set of port forwards through one host, as with
+// ssh -L and -R.
+type Tunnel struct {
+	Host   string   `toml:"host"`
+	Local  []string `toml:"local"`
+	Remote []string `toml:"remote"`
+}
+
+// Forwards parses the local and remote forwarding specs.
+func (t Tunnel) Forwards() (local, remote []forward, err error) {
+	for _, spec := range t.Local {
+		f, err := parseForward(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		local = append(local, f)
+	}
+	for _, spec := range t.Remote {
+		f, err := parseForward(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		remote = append(remote, f)
+	}
+	return local, remote, nil
+}
+
+// Validate checks the tunnel configuration for errors.
+func (t Tunnel) Validate(name string) error {
+	if t.Host == "" {
+		return fmt.Errorf("tunnel %q: missing 'host'", name)
+	}
+	if len(t.Local) == 0 && len(t.Remote) == 0 {
+		return fmt.Errorf("tunnel %q: missing 'local' or 'remote'", name)
+	}
+	if _, _, err := t.Forwards(); err != nil {
+		return fmt.Errorf("tunnel %q: %v", name, err)
+	}
+	return nil
+}
+
+// LookupHost returns the configured host with the given name, checked
+// with Validate. Names not in the config fall back to aliases with a
+// HostName in ~/.ssh/config.
+func (c *Config) LookupHost(name string) (Host, error) {
+	host, ok := c.lookupHost(name)
+	if !ok {
+		return Host{}, configErrorf("host %q not found in config", name)
+	}
+	if err := host.Validate(name); err != nil {
+		return Host{}, configErrorf("%v", err)
+	}
+	return host, nil
+}
+
+// lookupHost is LookupHost without validation.
+func (c *Config) lookupHost(name string) (Host, bool) {
+	if host, ok := c.Hosts[name]; ok {
+		return host, true
+	}
+	if lookupSSHConfig(c.sshConfig, name).HostName == "" {
+		return Host{}, false
+	}
+	return resolveHost(c.sshConfig, name, Host{}, c.Defaults), true
+}
+
+// Route returns the hosts that must be dialed to reach hostName, outermost
+// first and ending with hostName itself. The first jump host is reached
+// through its own jump setting; later hops in a chain are dialed through
+// the previous one, as with ssh -J.
+func (c *Config) Route(hostName string) ([]string, error) {
+	hops, err := c.routeHops(hostName)
+	if err != nil {
+		return nil, err
+	}
+	return hopNames(hops), nil
+}
+
+// routeHop is one host on the route to a host.
+type routeHop struct {
+	name string
+	host Host
+}
+
+// routeHops is Route with the resolved host of each hop.
+func (c *Config) routeHops(hostName string) ([]routeHop, error) {
+	host, ok := c.lookupHost(hostName)
+	if !ok {
+		return nil, fmt.Errorf("host %q not found", hostName)
+	}
+	return c.route(routeHop{hostName, host}, nil)
+}
+
+func (c *Config) route(target routeHop, seen []string) ([]routeHop, error) {
+	if slices.Contains(seen, target.name) {
+		return nil, fmt.Errorf("jump cycle: %s", strings.Join(append(seen, target.name), " -> "))
+	}
+	if err := target.host.Validate(target.name); err != nil {
+		return nil, err
+	}
+	seen = append(seen, target.name)
+
+	var jumps []routeHop
+	for _, name := range target.host.JumpHosts() {
+		host, ok := c.jumpHost(target.host, name)
+		if !ok {
+			return nil, fmt.Errorf("jump host %q not found", name)
+		}
+		if err := host.Validate(name); err != nil {
+			return nil, err
+		}
+		jumps = append(jumps, routeHop{name, host})
+	}
+	if len(jumps) == 0 {
+		return []routeHop{target}, nil
+	}
+
+	route, err := c.route(jumps[0], seen)
+	if err != nil {
+		return nil, err
+	}
+	for _, hop := range jumps[1:] {
+		names := hopNames(route)
+		if slices.Contains(seen, hop.name) || slices.Contains(names, hop.name) {
+			return nil, fmt.Errorf("jump cycle: %s", strings.Join(append(names, hop.name), " -> "))
+		}
+		route = append(route, hop)
+	}
+	return append(route, target), nil
+}
+
+func hopNames(hops []routeHop) []string {
+	names := make([]string, len(hops))
+	for i, hop := range hops {
+		names[i] = hop.name
+	}
+	return names
+}
+
+// jumpHost returns the host for name in host's jump chain. A ProxyJump
+// from ~/.ssh/config is a [user@]host[:port] list like ssh -J, so its
+// hops don't need to be configured hosts; a jump in sctl.toml must name
+// one.
+func (c *Config) jumpHost(host Host, name string) (Host, bool) {
+	if jump, ok := c.lookupHost(name); ok {
+		return jump, true
+	}
+	if host.Origins["jump"] != originSSHConfig {
+		return Host{}, false
+	}
+
+	user, addr, ok := strings.Cut(name, "@")
+	if !ok {
+		user, addr = "", name
+	}
+	port := 0
+	if h, p, err := net.SplitHostPort(addr); err == nil {
+		n, err := strconv.Atoi(p)
+		if err != nil || n <= 0 || n > 65535 {
+			return Host{}, false
+		}
+		addr, port = h, n
+	}
+	if addr == "" || strings.ContainsAny(addr, "@/ ") {
+		return Host{}, false
+	}
+	return resolveHost(c.sshConfig, addr, Host{Address: addr, User: user, Port: port}, c.Defaults), true
+}
+
 func loadConfig(configPath, filePath string) (*Config, error) {
 	if configPath != "" {
 		// --config: load only this file, skip hierarchical loading
 		cfg, err := loadConfigFile(configPath)
 		if err != nil {
-			return nil, err
+			return nil, withExitCode(exitConfig, err)
 		}
 		// Mark all as from this file
 		cfg.HostSources = make(map[string]string)
 		cfg.TaskSources = make(map[string]string)
+		cfg.TunnelSources = make(map[string]string)
 		for name := range cfg.Hosts {
 			cfg.HostSources[name] = configPath
 		}
 		for name := range cfg.Tasks {
 			cfg.TaskSources[name] = configPath
 		}
+		for name := range cfg.Tunnels {
+			cfg.TunnelSources[name] = configPath
+		}
+		cfg.sshConfig = loadUserSSHConfig()
+		applyDefaults(cfg)
 		return cfg, nil
 	}
 
 	// Hierarchical loading: global + local
 	cfg := &Config{
-		Hosts:       make(map[string]Host),
-		Tasks:       make(map[string]Task),
-		HostSources: make(map[string]string),
-		TaskSources: make(map[string]string),
+		Hosts:         make(map[string]Host),
+		Tasks:         make(map[string]Task),
+		Tunnels:       make(map[string]Tunnel),
+		HostSources:   make(map[string]string),
+		TaskSources:   make(map[string]string),
+		TunnelSources: make(map[string]string),
 	}
 
 	// 1. Load global config (~/.config/gosctl/sctl.toml)
@@ -119,18 +559,34 @@ func loadConfig(configPath, filePath string) (*Config, error) {
 		mergeConfigWithSource(cfg, localCfg, "local")
 	} else if filePath != "" {
 		// --file was explicit, so error if not found
-		return nil, fmt.Errorf("config file not found: %s", filePath)
+		return nil, withExitCode(exitConfig, fmt.Errorf("config file not found: %s", filePath))
 	}
 
 	// Check if we have any config at all
-	if len(cfg.Hosts) == 0 && len(cfg.Tasks) == 0 {
-		return nil, fmt.Errorf("no config found (checked ./sctl.toml and ~/.config/gosctl/sctl.toml)\nRun 'gosctl init' to create a sample configuration")
+	if len(cfg.Hosts) == 0 && len(cfg.Tasks) == 0 && len(cfg.Tunnels) == 0 {
+		return nil, withExitCode(exitConfig, fmt.Errorf("no config found (checked ./sctl.toml and ~/.config/gosctl/sctl.toml)\nRun 'gosctl init' to create a sample configuration"))
 	}
 
+	cfg.sshConfig = loadUserSSHConfig()
 	applyDefaults(cfg)
 	return cfg, nil
 }
 
+// loadUserSSHConfig loads ~/.ssh/config. Parse errors are reported but
+// don't prevent gosctl from running with its own config.
+func loadUserSSHConfig() *ssh_config.Config {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	sc, err := loadSSHConfig(filepath.Join(home, ".ssh", "config"))
+	if err != nil {
+		printWarning("Ignoring ~/.ssh/config: %v", err)
+		return nil
+	}
+	return sc
+}
+
 func loadConfigFile(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -148,12 +604,19 @@ func loadConfigFile(path string) (*Config, error) {
 	if cfg.Tasks == nil {
 		cfg.Tasks = make(map[string]Task)
 	}
+	if cfg.Tunnels == nil {
+		cfg.Tunnels = make(map[string]Tunnel)
+	}
 
-	applyDefaults(&cfg)
 	return &cfg, nil
 }
 
 func mergeConfigWithSource(base, overlay *Config, source string) {
+	// Defaults: overlay values win, base fills the rest
+	defaults := overlay.Defaults
+	defaults.inherit(base.Defaults)
+	base.Defaults = defaults
+
 	// Hosts: overlay overwrites base, track if overwritten
 	for name, host := range overlay.Hosts {
 		if _, exists := base.Hosts[name]; exists {
@@ -172,16 +635,21 @@ func mergeConfigWithSource(base, overlay *Config, source string) {
 		}
 		base.Tasks[name] = task
 	}
+	// Tunnels: overlay overwrites base, track if overwritten
+	for name, tunnel := range overlay.Tunnels {
+		if _, exists := base.Tunnels[name]; exists {
+			base.TunnelSources[name] = "local (overrides global)"
+		} else {
+			base.TunnelSources[name] = source
+		}
+		base.Tunnels[name] = tunnel
+	}
 }
 
+// applyDefaults fills unset host values from the [defaults] section and
+// ~/.ssh/config, then falls back to $USER and port 22.
 func applyDefaults(cfg *Config) {
 	for name, host := range cfg.Hosts {
-		if host.Port == 0 {
-			host.Port = 22
-		}
-		if host.User == "" {
-			host.User = os.Getenv("USER")
-		}
-		cfg.Hosts[name] = host
+		cfg.Hosts[name] = resolveHost(cfg.sshConfig, name, host, cfg.Defaults)
 	}
 }
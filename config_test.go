@@ -1,9 +1,15 @@
 package main
 
 import (
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/kevinburke/ssh_config"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -96,3 +102,344 @@ func TestLoadConfigInvalidTOML(t *testing.T) {
 		t.Error("expected error for invalid TOML")
 	}
 }
+
+func TestLoadConfigDurations(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+
+	// A bare number would otherwise be read as nanoseconds
+	for _, value := range []string{"10", "10.5", `"ten"`} {
+		content := "[hosts.web1]\naddress = \"web1\"\nconnect_timeout = " + value + "\n"
+		if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadConfig(configPath, "")
+		if err == nil || exitCode(err) != exitConfig {
+			t.Errorf("connect_timeout = %s: expected config error, got %v", value, err)
+		}
+	}
+
+	content := "[hosts.web1]\naddress = \"web1\"\nconnect_timeout = \"10s\"\nkeepalive_interval = \"-1s\"\n"
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(configPath, "")
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if web1 := cfg.Hosts["web1"]; web1.ConnectTimeout != duration(10*time.Second) || web1.KeepaliveInterval != duration(-time.Second) {
+		t.Errorf("unexpected durations %s, %s", web1.ConnectTimeout, web1.KeepaliveInterval)
+	}
+}
+
+func TestTaskWorkers(t *testing.T) {
+	tests := []struct {
+		name     string
+		task     Task
+		hosts    int
+		override int
+		want     int
+	}{
+		{"sequential by default", Task{}, 5, 0, 1},
+		{"parallel uses all hosts", Task{Parallel: true}, 5, 0, 5},
+		{"max_parallel limits", Task{Parallel: true, MaxParallel: 2}, 5, 0, 2},
+		{"max_parallel capped by hosts", Task{MaxParallel: 10}, 3, 0, 3},
+		{"flag overrides config", Task{MaxParallel: 2}, 5, 4, 4},
+		{"flag on sequential task", Task{}, 5, 3, 3},
+	}
+
+	for _, tt := range tests {
+		if got := tt.task.Workers(tt.hosts, tt.override); got != tt.want {
+			t.Errorf("%s: expected %d workers, got %d", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestConfigRoute(t *testing.T) {
+	cfg := &Config{Hosts: map[string]Host{
+		"bastion":   {Address: "bastion.example.com"},
+		"inner":     {Address: "10.0.0.1", Jump: "bastion"},
+		"app":       {Address: "10.0.1.1", Jump: "inner"},
+		"chained":   {Address: "10.0.2.1", Jump: "bastion, inner"},
+		"loop-a":    {Address: "a", Jump: "loop-b"},
+		"loop-b":    {Address: "b", Jump: "loop-a"},
+		"self":      {Address: "s", Jump: "bastion,self"},
+		"dangling":  {Address: "d", Jump: "missing"},
+		"badjump":   {Address: "j", Jump: "badpolicy"},
+		"badpolicy": {Address: "p", HostKeyPolicy: "trust"},
+	}}
+
+	tests := []struct {
+		host    string
+		want    []string
+		wantErr bool
+	}{
+		{host: "bastion", want: []string{"bastion"}},
+		{host: "inner", want: []string{"bastion", "inner"}},
+		{host: "app", want: []string{"bastion", "inner", "app"}},
+		{host: "chained", want: []string{"bastion", "inner", "chained"}},
+		{host: "loop-a", wantErr: true},
+		{host: "self", wantErr: true},
+		{host: "dangling", wantErr: true},
+		{host: "unknown", wantErr: true},
+		{host: "badjump", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := cfg.Route(tt.host)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got route %v", tt.host, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.host, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: expected route %v, got %v", tt.host, tt.want, got)
+		}
+	}
+}
+
+func TestResolveHostSSHConfig(t *testing.T) {
+	t.Setenv("USER", "local")
+	sc, err := ssh_config.Decode(strings.NewReader(`
+Host web1
+  HostName 10.0.0.5
+  User deploy
+  Port 2200
+  IdentityFile ~/.ssh/web_key
+  IdentitiesOnly yes
+
+Host bastion
+  HostName bastion.example.com
+  ProxyJump none
+`))
+	if err != nil {
+		t.Fatalf("failed to parse ssh config: %v", err)
+	}
+	cfg := &Config{
+		Hosts: map[string]Host{
+			"web1":  {Address: "web1", Port: 22},
+			"other": {Address: "other.example.com"},
+		},
+		sshConfig: sc,
+	}
+	applyDefaults(cfg)
+
+	web1 := cfg.Hosts["web1"]
+	if web1.Address != "10.0.0.5" {
+		t.Errorf("expected address from ssh config, got %s", web1.Address)
+	}
+	if web1.User != "deploy" {
+		t.Errorf("expected user from ssh config, got %s", web1.User)
+	}
+	if web1.Port != 22 {
+		t.Errorf("expected port from sctl.toml to win, got %d", web1.Port)
+	}
+	if !strings.HasSuffix(web1.KeyFile, "/.ssh/web_key") || strings.HasPrefix(web1.KeyFile, "~") {
+		t.Errorf("expected expanded key file from ssh config, got %s", web1.KeyFile)
+	}
+	if !web1.IdentitiesOnly {
+		t.Error("expected identities_only from ssh config")
+	}
+	if web1.Origins["user"] != originSSHConfig || web1.Origins["port"] != "" {
+		t.Errorf("unexpected origins: %v", web1.Origins)
+	}
+
+	other := cfg.Hosts["other"]
+	if other.User != "local" || other.Port != 22 {
+		t.Errorf("expected built-in defaults, got %s:%d", other.User, other.Port)
+	}
+	if other.Origins["user"] != originDefault {
+		t.Errorf("expected user origin default, got %q", other.Origins["user"])
+	}
+
+	// Aliases with a HostName are usable without a sctl.toml entry
+	bastion, err := cfg.LookupHost("bastion")
+	if err != nil {
+		t.Fatal("expected bastion to resolve from ssh config")
+	}
+	if bastion.Address != "bastion.example.com" || bastion.Jump != "" {
+		t.Errorf("unexpected bastion host: %+v", bastion)
+	}
+	if _, err := cfg.LookupHost("unknown"); err == nil {
+		t.Error("expected unknown alias not to resolve")
+	}
+}
+
+func TestResolveHostDefaultsBeatSSHConfig(t *testing.T) {
+	sc, err := ssh_config.Decode(strings.NewReader(`
+Host *
+  User alice
+  Port 2200
+`))
+	if err != nil {
+		t.Fatalf("failed to parse ssh config: %v", err)
+	}
+	cfg := &Config{
+		Defaults:  Host{User: "deploy"},
+		Hosts:     map[string]Host{"web1": {Address: "web1.example.com"}},
+		sshConfig: sc,
+	}
+	applyDefaults(cfg)
+
+	web1 := cfg.Hosts["web1"]
+	if web1.User != "deploy" || web1.Origins["user"] != originDefaults {
+		t.Errorf("expected user from [defaults] to beat Host *, got %s (%s)", web1.User, web1.Origins["user"])
+	}
+	if web1.Port != 2200 || web1.Origins["port"] != originSSHConfig {
+		t.Errorf("expected port from ssh config, got %d (%s)", web1.Port, web1.Origins["port"])
+	}
+}
+
+func TestSSHConfigProxyJump(t *testing.T) {
+	t.Setenv("USER", "local")
+	sc, err := ssh_config.Decode(strings.NewReader(`
+Host app
+  HostName 10.0.3.1
+  ProxyJump admin@bastion.example.com:2222,[fd00::1]:2200
+
+Host db
+  HostName 10.0.4.1
+  ProxyJump gw
+`))
+	if err != nil {
+		t.Fatalf("failed to parse ssh config: %v", err)
+	}
+	cfg := &Config{
+		Hosts: map[string]Host{
+			"app": {Address: "app"},
+			"db":  {Address: "db"},
+			"gw":  {Address: "gw.example.com", User: "ops"},
+			"bad": {Address: "10.0.5.1", Jump: "bastion.example.com"},
+		},
+		sshConfig: sc,
+	}
+	applyDefaults(cfg)
+
+	hops, err := cfg.routeHops("app")
+	if err != nil {
+		t.Fatalf("routeHops failed: %v", err)
+	}
+	want := []string{"admin@bastion.example.com:2222", "[fd00::1]:2200", "app"}
+	if names := hopNames(hops); !slices.Equal(names, want) {
+		t.Fatalf("expected route %v, got %v", want, names)
+	}
+	if h := hops[0].host; h.Address != "bastion.example.com" || h.User != "admin" || h.Port != 2222 {
+		t.Errorf("unexpected first hop: %s@%s:%d", h.User, h.Address, h.Port)
+	}
+	if h := hops[1].host; h.Address != "fd00::1" || h.User != "local" || h.Port != 2200 {
+		t.Errorf("unexpected second hop: %s@%s:%d", h.User, h.Address, h.Port)
+	}
+
+	// Configured hosts still win, and jumps in sctl.toml must name one
+	if hops, err := cfg.routeHops("db"); err != nil || hops[0].host.User != "ops" {
+		t.Errorf("expected configured gw as jump host, got %v, %v", hops, err)
+	}
+	if _, err := cfg.Route("bad"); err == nil {
+		t.Error("expected unknown jump host in sctl.toml to be an error")
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.toml")
+
+	configContent := `
+[defaults]
+user = "deploy"
+host_key_policy = "accept-new"
+auth_methods = ["publickey", "keyboard-interactive"]
+connect_timeout = "5s"
+forward_agent = true
+
+[hosts.web1]
+address = "web1.example.com"
+
+[hosts.web2]
+address = "web2.example.com"
+user = "admin"
+host_key_policy = "strict"
+auth_methods = ["password"]
+`
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatalf("failed to write test config: %v", err)
+	}
+
+	cfg, err := loadConfig(configPath, "")
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+
+	web1 := cfg.Hosts["web1"]
+	if web1.User != "deploy" || web1.HostKeyPolicy != hostKeyAcceptNew {
+		t.Errorf("expected values from [defaults], got user %q, policy %q", web1.User, web1.HostKeyPolicy)
+	}
+	if web1.Origins["user"] != originDefaults {
+		t.Errorf("expected user origin %q, got %q", originDefaults, web1.Origins["user"])
+	}
+	if !slices.Equal(web1.AuthMethods, []string{authPublicKey, authKeyboardInteractive}) {
+		t.Errorf("expected auth_methods from [defaults], got %v", web1.AuthMethods)
+	}
+	if web1.ConnectTimeout != duration(5*time.Second) {
+		t.Errorf("expected connect_timeout 5s from [defaults], got %s", web1.ConnectTimeout)
+	}
+	if !web1.ForwardAgent || web1.Origins["forward_agent"] != originDefaults {
+		t.Errorf("expected forward_agent from [defaults], got %v (%q)", web1.ForwardAgent, web1.Origins["forward_agent"])
+	}
+
+	web2 := cfg.Hosts["web2"]
+	if web2.User != "admin" || web2.HostKeyPolicy != hostKeyStrict {
+		t.Errorf("expected host values to win, got user %q, policy %q", web2.User, web2.HostKeyPolicy)
+	}
+	if !slices.Equal(web2.AuthMethods, []string{authPassword}) {
+		t.Errorf("expected host auth_methods to win, got %v", web2.AuthMethods)
+	}
+}
+
+func TestEnv(t *testing.T) {
+	if err := (Task{Host: "web1", Steps: []Step{{Run: "env"}}, Env: map[string]string{"APP_ENV": "prod"}}).Validate("deploy"); err != nil {
+		t.Errorf("expected valid env, got %v", err)
+	}
+	for _, name := range []string{"", "1ABC", "FOO-BAR", "A B", "X;rm"} {
+		if err := (Host{Address: "h", Env: map[string]string{name: "x"}}).Validate("web1"); err == nil {
+			t.Errorf("expected error for env name %q", name)
+		}
+	}
+
+	t.Setenv("GOSCTL_TEST_TOKEN", "secret")
+	env, err := parseEnvFlags([]string{"A=1", "B=x=y", "C=", "GOSCTL_TEST_TOKEN"})
+	if err != nil {
+		t.Fatalf("parseEnvFlags failed: %v", err)
+	}
+	want := map[string]string{"A": "1", "B": "x=y", "C": "", "GOSCTL_TEST_TOKEN": "secret"}
+	if !maps.Equal(env, want) {
+		t.Errorf("expected %v, got %v", want, env)
+	}
+	if _, err := parseEnvFlags([]string{"GOSCTL_TEST_UNSET_VAR"}); err == nil {
+		t.Error("expected error for unset local variable")
+	}
+
+	// Invalid values surface from LookupHost as config errors
+	cfg := &Config{Hosts: map[string]Host{
+		"policy": {Address: "h", HostKeyPolicy: "trust"},
+		"auth":   {Address: "h", AuthMethods: []string{"kerberos"}},
+		"env":    {Address: "h", Env: map[string]string{"A;B": "x"}},
+	}}
+	for name := range cfg.Hosts {
+		if _, err := cfg.LookupHost(name); err == nil || exitCode(err) != exitConfig {
+			t.Errorf("%s: expected config error, got %v", name, err)
+		}
+	}
+	if _, err := exportEnv(map[string]string{"A; rm -rf x; B": "1"}, "true"); err == nil {
+		t.Error("expected exportEnv to reject an invalid name")
+	}
+
+	// Task values win over host values
+	merged := mergeMaps(map[string]string{"A": "host", "B": "host"}, map[string]string{"A": "task"})
+	if merged["A"] != "task" || merged["B"] != "host" {
+		t.Errorf("expected task env to override host env, got %v", merged)
+	}
+}
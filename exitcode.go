@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Exit codes, besides the remote command's own status which exec and run
+// pass through. Connection failures use 255 like ssh, config errors
+// EX_CONFIG from sysexits.h and interrupts 128+SIGINT like a shell.
+const (
+	exitFailure   = 1
+	exitConfig    = 78
+	exitInterrupt = 130
+	exitConnect   = 255
+)
+
+// exitCodeHelp is shown in --help.
+const exitCodeHelp = `Exit codes:
+  N       exit status N of the failed remote command (exec, run)
+  128+N   remote command killed by signal N
+  1       other failures, or a parallel run with failed hosts
+  78      configuration error
+  130     interrupted (Ctrl-C)
+  255     connection or authentication failure`
+
+// exitError attaches an exit code to an error.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+func withExitCode(code int, err error) error {
+	return &exitError{code: code, err: err}
+}
+
+// configErrorf is errorf for mistakes in the config or in references to
+// it, like an unknown host.
+func configErrorf(format string, a ...any) error {
+	return withExitCode(exitConfig, errorf(format, a...))
+}
+
+// exitCode picks the process exit code for an error returned by a command.
+func exitCode(err error) int {
+	if errors.Is(err, errInterrupted) {
+		return exitInterrupt
+	}
+	var ee *exitError
+	if errors.As(err, &ee) {
+		return ee.code
+	}
+	// Signal deaths are already 128+N here
+	var remote *ssh.ExitError
+	if errors.As(err, &remote) {
+		return remote.ExitStatus()
+	}
+	return exitFailure
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	_, configErr := loadConfig("/nonexistent/path/config.toml", "")
+
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"plain", errors.New("boom"), exitFailure},
+		{"config", configErr, exitConfig},
+		{"unknown host", configErrorf("host %q not found in config", "web1"), exitConfig},
+		{"connect", errorf("ssh connection failed: %w", withExitCode(exitConnect, errors.New("refused"))), exitConnect},
+		{"interrupted", errorf("step 1 on web1 %w: uptime", errInterrupted), exitInterrupt},
+		{"parallel interrupted", errorf("task %w on %d of %d hosts", errInterrupted, 1, 2), exitInterrupt},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.err); got != tt.want {
+			t.Errorf("%s: exitCode(%v) = %d, want %d", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
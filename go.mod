@@ -4,8 +4,12 @@ go 1.25.5
 
 require (
 	github.com/BurntSushi/toml v1.6.0
+	github.com/kevinburke/ssh_config v1.6.0
+	github.com/pkg/sftp v1.13.10
 	github.com/urfave/cli/v3 v3.6.1
 	golang.org/x/crypto v0.47.0
+	golang.org/x/sys v0.40.0
+	golang.org/x/term v0.39.0
 )
 
-require golang.org/x/sys v0.40.0 // indirect
+require github.com/kr/fs v0.1.0 // indirect
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Host key policies for hosts missing from known_hosts. A changed key is
+// always rejected.
+const (
+	hostKeyStrict    = "strict"     // reject unknown hosts
+	hostKeyAcceptNew = "accept-new" // trust and remember unknown hosts
+	hostKeyPrompt    = "prompt"     // ask before trusting unknown hosts
+)
+
+// knownHostsMu serializes appends to known_hosts from concurrent hosts.
+var knownHostsMu sync.Mutex
+
+// buildHostKeyCallback returns the host key check for host and the host
+// key algorithms to negotiate, so the server offers a key we can verify.
+// Pinned keys in the config take precedence over known_hosts.
+func buildHostKeyCallback(ctx context.Context, host Host) (ssh.HostKeyCallback, []string, error) {
+	if host.HostKey != "" || host.HostKeyFingerprint != "" {
+		return pinnedHostKeyCallback(host)
+	}
+
+	knownHostsPath := host.KnownHostsFile
+	if knownHostsPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil, err
+		}
+		knownHostsPath = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	policy := host.HostKeyPolicy
+	if policy == "" {
+		policy = hostKeyStrict
+	}
+	if policy != hostKeyStrict {
+		// Start an empty known_hosts so the first host can be added
+		if err := ensureFile(knownHostsPath); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	check, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load known_hosts: %w (add host with: ssh-keyscan -H %s >> %s)", err, host.Address, knownHostsPath)
+	}
+
+	authorities := certAuthorityKeys(knownHostsPath)
+
+	callback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		if known := withoutAuthorities(keyErr.Want, authorities); len(known) > 0 {
+			return hostKeyChangedError(hostname, key, known)
+		}
+
+		fingerprint := ssh.FingerprintSHA256(key)
+		switch policy {
+		case hostKeyAcceptNew:
+			printWarning("Adding %s (%s %s) to %s", hostname, key.Type(), fingerprint, knownHostsPath)
+		case hostKeyPrompt:
+			ok, err := confirm(ctx, fmt.Sprintf("The authenticity of host %s can't be established.\n%s key fingerprint is %s.\nTrust this host and add it to %s? [y/N] ",
+				hostname, key.Type(), fingerprint, knownHostsPath))
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("host key for %s not trusted", hostname)
+			}
+		default:
+			return fmt.Errorf("host key for %s is unknown (%s %s); add it with: ssh-keyscan -H %s >> %s, or set host_key_policy = %q",
+				hostname, key.Type(), fingerprint, host.Address, knownHostsPath, hostKeyAcceptNew)
+		}
+		return appendKnownHost(knownHostsPath, hostname, key)
+	}
+
+	addr := fmt.Sprintf("%s:%d", host.Address, host.Port)
+	return callback, knownHostKeyAlgorithms(check, addr, authorities), nil
+}
+
+// knownHostKeyAlgorithms returns the algorithms of the keys known_hosts
+// lists for addr. Without this, the server may offer a different key type
+// than the one on record and the host would look like its key had changed.
+// Host certificates are only negotiated if a @cert-authority line covers
+// the host.
+func knownHostKeyAlgorithms(check ssh.HostKeyCallback, addr string, authorities []ssh.PublicKey) []string {
+	// Checking a key that can't match makes knownhosts list the known keys
+	probe, _ := ssh.NewPublicKey(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)).Public())
+	err := check(addr, &net.TCPAddr{}, probe)
+
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return plainHostKeyAlgorithms()
+	}
+	known := withoutAuthorities(keyErr.Want, authorities)
+	if len(known) < len(keyErr.Want) {
+		// Default preference, certificates first
+		return nil
+	}
+	if len(known) == 0 {
+		return plainHostKeyAlgorithms()
+	}
+
+	var algos []string
+	for _, k := range known {
+		for _, algo := range algorithmsForKey(k.Key) {
+			if !slices.Contains(algos, algo) {
+				algos = append(algos, algo)
+			}
+		}
+	}
+	return algos
+}
+
+// pinnedHostKeyCallback accepts only the host key or fingerprint pinned
+// in the config, without consulting known_hosts.
+func pinnedHostKeyCallback(host Host) (ssh.HostKeyCallback, []string, error) {
+	var pinned ssh.PublicKey
+	var algos []string
+	if host.HostKey != "" {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(host.HostKey))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid host_key: %w", err)
+		}
+		pinned = key
+		algos = algorithmsForKey(key)
+	} else {
+		// A fingerprint pins the plain key, not a certificate
+		algos = plainHostKeyAlgorithms()
+	}
+
+	callback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+		if pinned != nil && !bytes.Equal(key.Marshal(), pinned.Marshal()) {
+			return fmt.Errorf("host key for %s does not match host_key\n  pinned:   %s %s\n  received: %s %s",
+				hostname, pinned.Type(), ssh.FingerprintSHA256(pinned), key.Type(), fingerprint)
+		}
+		if host.HostKeyFingerprint != "" && fingerprint != strings.TrimRight(host.HostKeyFingerprint, "=") {
+			return fmt.Errorf("host key for %s does not match host_key_fingerprint\n  pinned:   %s\n  received: %s %s",
+				hostname, host.HostKeyFingerprint, key.Type(), fingerprint)
+		}
+		return nil
+	}
+	return callback, algos, nil
+}
+
+// algorithmsForKey returns the host key algorithms that verify with key.
+func algorithmsForKey(key ssh.PublicKey) []string {
+	if key.Type() == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{key.Type()}
+}
+
+// plainHostKeyAlgorithms returns the supported host key algorithms
+// without certificates, in the default preference order.
+func plainHostKeyAlgorithms() []string {
+	return slices.DeleteFunc(ssh.SupportedAlgorithms().HostKeys, func(algo string) bool {
+		return strings.Contains(algo, "-cert-")
+	})
+}
+
+// certAuthorityKeys returns the keys of the @cert-authority lines in a
+// known_hosts file.
+func certAuthorityKeys(path string) []ssh.PublicKey {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var keys []ssh.PublicKey
+	for len(data) > 0 {
+		marker, _, key, _, rest, err := ssh.ParseKnownHosts(data)
+		if err != nil {
+			break
+		}
+		if marker == "cert-authority" {
+			keys = append(keys, key)
+		}
+		data = rest
+	}
+	return keys
+}
+
+// withoutAuthorities drops certificate authorities from the keys
+// knownhosts reports for a host; only plain host keys can have changed.
+func withoutAuthorities(known []knownhosts.KnownKey, authorities []ssh.PublicKey) []knownhosts.KnownKey {
+	return slices.DeleteFunc(slices.Clone(known), func(k knownhosts.KnownKey) bool {
+		return slices.ContainsFunc(authorities, func(ca ssh.PublicKey) bool {
+			return bytes.Equal(ca.Marshal(), k.Key.Marshal())
+		})
+	})
+}
+
+// hostKeyChangedError describes a mismatch between the known and the
+// received host key.
+func hostKeyChangedError(hostname string, key ssh.PublicKey, known []knownhosts.KnownKey) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "host key for %s has changed, possible man-in-the-middle attack!\n", hostname)
+	for _, k := range known {
+		fmt.Fprintf(&b, "  known:    %s %s (%s:%d)\n", k.Key.Type(), ssh.FingerprintSHA256(k.Key), k.Filename, k.Line)
+	}
+	fmt.Fprintf(&b, "  received: %s %s\n", key.Type(), ssh.FingerprintSHA256(key))
+	fmt.Fprintf(&b, "If the change is expected, remove the old key with: ssh-keygen -R %q", knownhosts.Normalize(hostname))
+	return errors.New(b.String())
+}
+
+// appendKnownHost adds key to the known_hosts file with a hashed hostname.
+func appendKnownHost(path, hostname string, key ssh.PublicKey) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	line := knownhosts.Line([]string{knownhosts.HashHostname(knownhosts.Normalize(hostname))}, key)
+	_, err = fmt.Fprintln(f, line)
+	return err
+}
+
+// ensureFile creates path and its directory if they don't exist.
+func ensureFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
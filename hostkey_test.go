@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("failed to convert key: %v", err)
+	}
+	return key
+}
+
+func TestHostKeyPolicy(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 22}
+	key := newTestHostKey(t)
+
+	// strict rejects unknown hosts, without creating known_hosts
+	if _, _, err := buildHostKeyCallback(context.Background(), Host{}); err == nil {
+		t.Fatal("expected error for missing known_hosts under strict policy")
+	}
+
+	// accept-new adds the key in hashed form
+	check, _, err := buildHostKeyCallback(context.Background(), Host{HostKeyPolicy: hostKeyAcceptNew})
+	if err != nil {
+		t.Fatalf("buildHostKeyCallback failed: %v", err)
+	}
+	if err := check("web1:22", addr, key); err != nil {
+		t.Fatalf("expected unknown host to be accepted: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		t.Fatalf("failed to read known_hosts: %v", err)
+	}
+	if !strings.HasPrefix(string(data), "|1|") {
+		t.Errorf("expected hashed known_hosts entry, got %q", data)
+	}
+
+	// The stored key is trusted under strict, a changed key never is
+	check, _, err = buildHostKeyCallback(context.Background(), Host{HostKeyPolicy: hostKeyStrict})
+	if err != nil {
+		t.Fatalf("buildHostKeyCallback failed: %v", err)
+	}
+	if err := check("web1:22", addr, key); err != nil {
+		t.Errorf("expected stored key to be trusted: %v", err)
+	}
+	if err := check("web2:22", addr, key); err == nil {
+		t.Error("expected unknown host to be rejected under strict policy")
+	}
+
+	check, _, err = buildHostKeyCallback(context.Background(), Host{HostKeyPolicy: hostKeyAcceptNew})
+	if err != nil {
+		t.Fatalf("buildHostKeyCallback failed: %v", err)
+	}
+	err = check("web1:22", addr, newTestHostKey(t))
+	if err == nil || !strings.Contains(err.Error(), "has changed") {
+		t.Errorf("expected changed key error, got %v", err)
+	}
+}
+
+func TestPinnedHostKey(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 22}
+	key := newTestHostKey(t)
+	other := newTestHostKey(t)
+
+	check, algos, err := buildHostKeyCallback(context.Background(), Host{HostKey: string(ssh.MarshalAuthorizedKey(key))})
+	if err != nil {
+		t.Fatalf("buildHostKeyCallback failed: %v", err)
+	}
+	if len(algos) != 1 || algos[0] != ssh.KeyAlgoED25519 {
+		t.Errorf("expected algorithms restricted to ed25519, got %v", algos)
+	}
+	if err := check("web1:22", addr, key); err != nil {
+		t.Errorf("expected pinned key to be accepted: %v", err)
+	}
+	if err := check("web1:22", addr, other); err == nil {
+		t.Error("expected other key to be rejected")
+	}
+
+	check, _, err = buildHostKeyCallback(context.Background(), Host{HostKeyFingerprint: ssh.FingerprintSHA256(key)})
+	if err != nil {
+		t.Fatalf("buildHostKeyCallback failed: %v", err)
+	}
+	if err := check("web1:22", addr, key); err != nil {
+		t.Errorf("expected pinned fingerprint to be accepted: %v", err)
+	}
+	if err := check("web1:22", addr, other); err == nil {
+		t.Error("expected other fingerprint to be rejected")
+	}
+}
+
+func TestKnownHostsFile(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	path := filepath.Join(t.TempDir(), "ci_known_hosts")
+	key := newTestHostKey(t)
+
+	line := "[web1]:2222 " + string(ssh.MarshalAuthorizedKey(key))
+	if err := os.WriteFile(path, []byte(line), 0600); err != nil {
+		t.Fatalf("failed to write known_hosts: %v", err)
+	}
+
+	check, algos, err := buildHostKeyCallback(context.Background(), Host{Address: "web1", Port: 2222, KnownHostsFile: path})
+	if err != nil {
+		t.Fatalf("buildHostKeyCallback failed: %v", err)
+	}
+	if len(algos) != 1 || algos[0] != ssh.KeyAlgoED25519 {
+		t.Errorf("expected algorithms of the known key, got %v", algos)
+	}
+	if err := check("web1:2222", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 2222}, key); err != nil {
+		t.Errorf("expected key from known_hosts_file to be trusted: %v", err)
+	}
+}
+
+func TestHostCertificateAuthority(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	path := filepath.Join(t.TempDir(), "known_hosts")
+
+	_, ca := newTestKey(t)
+	cert := &ssh.Certificate{
+		Key:             newTestHostKey(t),
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{"web1.example.com"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("failed to sign host cert: %v", err)
+	}
+
+	line := "@cert-authority *.example.com " + string(ssh.MarshalAuthorizedKey(ca.PublicKey()))
+	if err := os.WriteFile(path, []byte(line), 0600); err != nil {
+		t.Fatalf("failed to write known_hosts: %v", err)
+	}
+
+	check, algos, err := buildHostKeyCallback(context.Background(), Host{Address: "web1.example.com", Port: 22, KnownHostsFile: path})
+	if err != nil {
+		t.Fatalf("buildHostKeyCallback failed: %v", err)
+	}
+	if algos != nil {
+		t.Errorf("expected default algorithms including certificates, got %v", algos)
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 22}
+	if err := check("web1.example.com:22", addr, cert); err != nil {
+		t.Errorf("expected host certificate to be trusted: %v", err)
+	}
+}
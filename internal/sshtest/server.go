@@ -0,0 +1,359 @@
+// Package sshtest runs an SSH server inside the test process, so the
+// client can be tested end to end without a real host. Commands run in a
+// local shell, or a fake handler, and everything the server receives is
+// recorded.
+package sshtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Config controls what the server accepts. The zero value accepts no
+// authentication at all.
+type Config struct {
+	// Password is accepted by password auth and, if KeyboardInteractive
+	// is set, as the answer to a keyboard-interactive password prompt
+	Password            string
+	KeyboardInteractive bool
+
+	// AuthorizedKeys are accepted by publickey auth
+	AuthorizedKeys []ssh.PublicKey
+
+	// RejectEnv refuses env requests, like sshd without AcceptEnv
+	RejectEnv bool
+
+	// Handler runs commands; nil runs them with sh -c
+	Handler Handler
+}
+
+// Handler runs an exec request and returns its exit status. ctx is
+// cancelled when the client sends a signal or closes the session.
+type Handler func(ctx context.Context, e Exec, stdin io.Reader, stdout, stderr io.Writer) int
+
+// Exec is a command received by the server.
+type Exec struct {
+	User    string
+	Command string
+	Env     map[string]string // set with env requests
+	Stdin   []byte            // read by the command
+	Signals []string          // received while it ran, e.g. "INT"
+}
+
+// Server is a running test server.
+type Server struct {
+	// HostKey is the server's host key
+	HostKey ssh.PublicKey
+
+	ln     net.Listener
+	config *ssh.ServerConfig
+	cfg    Config
+
+	mu    sync.Mutex
+	conns []net.Conn
+	execs []Exec
+	auths []string
+
+	wg sync.WaitGroup
+}
+
+// NewServer starts a server on a free localhost port. It is closed when
+// the test ends. Without a Handler the test is skipped if sh is missing,
+// as on Windows.
+func NewServer(t testing.TB, cfg Config) *Server {
+	t.Helper()
+	if cfg.Handler == nil {
+		if _, err := exec.LookPath("sh"); err != nil {
+			t.Skip("sshtest: commands need sh, which is not in PATH")
+		}
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("sshtest: generating host key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("sshtest: host key: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("sshtest: listen: %v", err)
+	}
+
+	s := &Server{HostKey: signer.PublicKey(), ln: ln, cfg: cfg}
+	s.config = &ssh.ServerConfig{
+		AuthLogCallback: func(conn ssh.ConnMetadata, method string, err error) {
+			if err == nil {
+				s.mu.Lock()
+				s.auths = append(s.auths, method)
+				s.mu.Unlock()
+			}
+		},
+	}
+	if cfg.Password != "" {
+		s.config.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != cfg.Password {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		}
+	}
+	if cfg.Password != "" && cfg.KeyboardInteractive {
+		s.config.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := client("", "", []string{"Password: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) != 1 || answers[0] != cfg.Password {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		}
+	}
+	if len(cfg.AuthorizedKeys) > 0 {
+		s.config.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			for _, authorized := range cfg.AuthorizedKeys {
+				if bytes.Equal(key.Marshal(), authorized.Marshal()) {
+					return nil, nil
+				}
+			}
+			return nil, errors.New("unknown key")
+		}
+	}
+	s.config.AddHostKey(signer)
+
+	s.wg.Go(s.serve)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Host returns the address the server listens on.
+func (s *Server) Host() string {
+	return s.ln.Addr().(*net.TCPAddr).IP.String()
+}
+
+// Port returns the port the server listens on.
+func (s *Server) Port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+// HostKeyLine returns the host key in authorized_keys format.
+func (s *Server) HostKeyLine() string {
+	return string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(s.HostKey)))
+}
+
+// Execs returns the commands received so far, in order.
+func (s *Server) Execs() []Exec {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.execs)
+}
+
+// Commands returns the command lines received so far, in order.
+func (s *Server) Commands() []string {
+	var commands []string
+	for _, e := range s.Execs() {
+		commands = append(commands, e.Command)
+	}
+	return commands
+}
+
+// Auths returns the auth method that succeeded for each connection.
+func (s *Server) Auths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.auths)
+}
+
+// Close stops the server and closes all connections.
+func (s *Server) Close() {
+	s.ln.Close()
+	s.mu.Lock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		s.wg.Go(func() { s.handleConn(conn) })
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		s.wg.Go(func() { s.handleSession(sconn.User(), ch, chReqs) })
+	}
+}
+
+func (s *Server) handleSession(user string, ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+
+	env := make(map[string]string)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	started := false
+	idx := -1 // of the exec, once started
+
+	for req := range reqs {
+		switch req.Type {
+		case "env":
+			var msg struct{ Name, Value string }
+			if s.cfg.RejectEnv || ssh.Unmarshal(req.Payload, &msg) != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			env[msg.Name] = msg.Value
+			req.Reply(true, nil)
+
+		case "pty-req":
+			req.Reply(true, nil)
+
+		case "exec":
+			var msg struct{ Command string }
+			if started || ssh.Unmarshal(req.Payload, &msg) != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			started = true
+
+			s.mu.Lock()
+			idx = len(s.execs)
+			s.execs = append(s.execs, Exec{User: user, Command: msg.Command, Env: maps.Clone(env)})
+			s.mu.Unlock()
+			go func() {
+				defer close(done)
+				s.exec(ctx, ch, idx)
+			}()
+
+		case "subsystem":
+			var msg struct{ Name string }
+			if started || ssh.Unmarshal(req.Payload, &msg) != nil || msg.Name != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			started = true
+			go func() {
+				defer close(done)
+				server, err := sftp.NewServer(ch)
+				if err == nil {
+					server.Serve()
+					server.Close()
+				}
+				ch.Close()
+			}()
+
+		case "signal":
+			var msg struct{ Signal string }
+			if ssh.Unmarshal(req.Payload, &msg) == nil {
+				s.mu.Lock()
+				if idx >= 0 {
+					s.execs[idx].Signals = append(s.execs[idx].Signals, msg.Signal)
+				}
+				s.mu.Unlock()
+			}
+			cancel()
+
+		default:
+			req.Reply(false, nil)
+		}
+	}
+
+	// The client closed the session
+	cancel()
+	if started {
+		<-done
+	}
+}
+
+// exec runs the command recorded at idx and reports its exit status.
+func (s *Server) exec(ctx context.Context, ch ssh.Channel, idx int) {
+	s.mu.Lock()
+	e := s.execs[idx]
+	s.mu.Unlock()
+
+	var stdin bytes.Buffer
+	handler := s.cfg.Handler
+	if handler == nil {
+		handler = shell
+	}
+	status := handler(ctx, e, io.TeeReader(ch, &stdin), ch, ch.Stderr())
+
+	s.mu.Lock()
+	s.execs[idx].Stdin = stdin.Bytes()
+	s.mu.Unlock()
+
+	ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+	ch.Close()
+}
+
+// shell runs the command with sh -c, with the environment it was sent.
+// A signal from the client interrupts it.
+func shell(ctx context.Context, e Exec, stdin io.Reader, stdout, stderr io.Writer) int {
+	cmd := exec.CommandContext(ctx, "sh", "-c", e.Command)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Env = os.Environ()
+	for name, value := range e.Env {
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+	if cmd.ProcessState == nil {
+		fmt.Fprintln(stderr, err)
+		return 127
+	}
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return cmd.ProcessState.ExitCode()
+}
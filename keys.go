@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// decryptedKeys caches decrypted private keys by path for the rest of the
+// run, so each passphrase is asked for at most once.
+var decryptedKeys = struct {
+	sync.Mutex
+	signers map[string]ssh.Signer
+}{signers: make(map[string]ssh.Signer)}
+
+// publicKeySigner loads the private key at keyPath. Encrypted keys are
+// returned as a signer that asks for the passphrase only when the server
+// accepts the key; cancelling ctx abandons that prompt. Returns nil if the
+// key can't be used.
+func publicKeySigner(ctx context.Context, keyPath, passphraseCmd string) ssh.Signer {
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err == nil {
+		return signer
+	}
+
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		printWarning("Skipping key %s: %v", keyPath, err)
+		return nil
+	}
+
+	decryptedKeys.Lock()
+	cached, ok := decryptedKeys.signers[keyPath]
+	decryptedKeys.Unlock()
+	if ok {
+		return cached
+	}
+
+	// Older key formats don't embed the public key; fall back to the .pub file
+	pub := missing.PublicKey
+	if pub == nil {
+		if pub, err = readPublicKey(keyPath + ".pub"); err != nil {
+			printWarning("Skipping encrypted key %s: no public key found (%s.pub)", keyPath, keyPath)
+			return nil
+		}
+	}
+
+	return &encryptedSigner{ctx: ctx, path: keyPath, key: key, pub: pub, passphraseCmd: passphraseCmd}
+}
+
+func readPublicKey(path string) (ssh.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	return pub, err
+}
+
+// readCertificate reads an OpenSSH certificate (a *-cert.pub file).
+func readCertificate(path string) (*ssh.Certificate, error) {
+	pub, err := readPublicKey(path)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a certificate", path)
+	}
+	return cert, nil
+}
+
+// withCertificates puts a certificate signer in front of the signers for
+// each certificate whose key one of them holds. Certificates that have
+// expired or have no matching key are skipped.
+func withCertificates(signers []ssh.Signer, certs []*ssh.Certificate) []ssh.Signer {
+	now := uint64(time.Now().Unix())
+	var certSigners []ssh.Signer
+	for _, cert := range certs {
+		if cert.ValidBefore != ssh.CertTimeInfinity && now >= cert.ValidBefore {
+			continue
+		}
+		for _, signer := range signers {
+			if !bytes.Equal(signer.PublicKey().Marshal(), cert.Key.Marshal()) {
+				continue
+			}
+			if certSigner, err := ssh.NewCertSigner(cert, signer); err == nil {
+				certSigners = append(certSigners, certSigner)
+			}
+			break
+		}
+	}
+	return append(certSigners, signers...)
+}
+
+// encryptedSigner defers decrypting a passphrase-protected key until the
+// server has accepted its public key and a signature is needed.
+type encryptedSigner struct {
+	ctx           context.Context // of the dial, for the passphrase prompt
+	path          string
+	key           []byte
+	pub           ssh.PublicKey
+	passphraseCmd string
+}
+
+func (s *encryptedSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *encryptedSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	signer, err := decryptKey(s.ctx, s.path, s.key, s.passphraseCmd)
+	if err != nil {
+		return nil, err
+	}
+	return signer.Sign(rand, data)
+}
+
+// SignWithAlgorithm lets RSA keys use rsa-sha2-* signatures.
+func (s *encryptedSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	signer, err := decryptKey(s.ctx, s.path, s.key, s.passphraseCmd)
+	if err != nil {
+		return nil, err
+	}
+	if as, ok := signer.(ssh.AlgorithmSigner); ok {
+		return as.SignWithAlgorithm(rand, data, algorithm)
+	}
+	return signer.Sign(rand, data)
+}
+
+// decryptKey decrypts key using the output of passphraseCmd, or a
+// passphrase read from the terminal if no command is configured.
+func decryptKey(ctx context.Context, path string, key []byte, passphraseCmd string) (ssh.Signer, error) {
+	decryptedKeys.Lock()
+	defer decryptedKeys.Unlock()
+
+	if signer, ok := decryptedKeys.signers[path]; ok {
+		return signer, nil
+	}
+
+	if passphraseCmd != "" {
+		passphrase, err := runSecretCmd(passphraseCmd)
+		if err != nil {
+			return nil, fmt.Errorf("passphrase_cmd for %s failed: %w", path, err)
+		}
+		signer, err := ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+		if err != nil {
+			return nil, fmt.Errorf("decrypting %s with passphrase_cmd: %w", path, err)
+		}
+		decryptedKeys.signers[path] = signer
+		return signer, nil
+	}
+
+	prompt := fmt.Sprintf("Enter passphrase for key '%s': ", path)
+	for range 3 {
+		passphrase, err := readSecret(ctx, prompt)
+		if err != nil {
+			return nil, fmt.Errorf("reading passphrase for %s: %w", path, err)
+		}
+		signer, err := ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+		if err == nil {
+			decryptedKeys.signers[path] = signer
+			return signer, nil
+		}
+		if !errors.Is(err, x509.IncorrectPasswordError) {
+			return nil, fmt.Errorf("decrypting %s: %w", path, err)
+		}
+		prompt = fmt.Sprintf("Bad passphrase, try again for '%s': ", path)
+	}
+	return nil, fmt.Errorf("too many incorrect passphrases for %s", path)
+}
+
+// runSecretCmd runs a shell command and returns its output without the
+// trailing newline, for reading secrets from password managers.
+func runSecretCmd(command string) (string, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
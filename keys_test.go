@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestPublicKeySignerEncrypted(t *testing.T) {
+	needShell(t)
+	keyPath, _ := writeTestKey(t, "s3cret")
+
+	signer := publicKeySigner(context.Background(), keyPath, "echo s3cret")
+	if signer == nil {
+		t.Fatal("expected signer for encrypted key")
+	}
+	if _, ok := signer.(*encryptedSigner); !ok {
+		t.Fatalf("expected deferred signer, got %T", signer)
+	}
+
+	sig, err := signer.Sign(rand.Reader, []byte("data"))
+	if err != nil {
+		t.Fatalf("sign failed: %v", err)
+	}
+	if err := signer.PublicKey().Verify([]byte("data"), sig); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+
+	// The decrypted key is cached for the rest of the run
+	if _, ok := publicKeySigner(context.Background(), keyPath, "false").(*encryptedSigner); ok {
+		t.Error("expected cached decrypted signer on second load")
+	}
+}
+
+func TestPublicKeySignerWrongPassphrase(t *testing.T) {
+	keyPath, _ := writeTestKey(t, "s3cret")
+
+	signer := publicKeySigner(context.Background(), keyPath, "echo wrong")
+	if signer == nil {
+		t.Fatal("expected signer for encrypted key")
+	}
+	if _, err := signer.Sign(rand.Reader, []byte("data")); err == nil {
+		t.Error("expected sign to fail with wrong passphrase")
+	}
+}
+
+func TestWithCertificates(t *testing.T) {
+	_, signer := newTestKey(t)
+	_, ca := newTestKey(t)
+
+	newCert := func(validBefore uint64) *ssh.Certificate {
+		cert := &ssh.Certificate{
+			Key:         signer.PublicKey(),
+			CertType:    ssh.UserCert,
+			ValidBefore: validBefore,
+		}
+		if err := cert.SignCert(rand.Reader, ca); err != nil {
+			t.Fatalf("failed to sign cert: %v", err)
+		}
+		return cert
+	}
+
+	signers := withCertificates([]ssh.Signer{signer}, []*ssh.Certificate{newCert(ssh.CertTimeInfinity)})
+	if len(signers) != 2 {
+		t.Fatalf("expected cert signer plus key signer, got %d", len(signers))
+	}
+	if _, ok := signers[0].PublicKey().(*ssh.Certificate); !ok {
+		t.Errorf("expected certificate to be offered first, got %T", signers[0].PublicKey())
+	}
+
+	expired := withCertificates([]ssh.Signer{signer}, []*ssh.Certificate{newCert(1)})
+	if len(expired) != 1 {
+		t.Errorf("expected expired certificate to be skipped, got %d signers", len(expired))
+	}
+}
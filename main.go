@@ -2,13 +2,21 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
+	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"slices"
 	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/urfave/cli/v3"
+	"golang.org/x/term"
 )
 
 var appVersion = "dev"
@@ -18,9 +26,35 @@ func main() {
 		fmt.Printf("gosctl %s\n", appVersion)
 	}
 
-	app := &cli.Command{
+	// Ctrl-C cancels the context so remote commands, transfers, connects
+	// and prompts can be stopped and connections closed
+	ctx, stop := notifyInterrupt(context.Background())
+	err := newApp().Run(ctx, os.Args)
+	stop()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitCode(err))
+	}
+}
+
+// notifyInterrupt returns a context cancelled by the first Ctrl-C or
+// SIGTERM. Later signals get the default handling, so another Ctrl-C
+// quits right away.
+func notifyInterrupt(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(parent, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+// newApp returns the command line interface.
+func newApp() *cli.Command {
+	return &cli.Command{
 		Name:                  "gosctl",
 		Usage:                 "Remote service control over SSH",
+		Description:           exitCodeHelp,
 		Version:               appVersion,
 		EnableShellCompletion: true,
 		Flags: []cli.Flag{
@@ -47,6 +81,25 @@ func main() {
 						Usage:    "target host",
 						Required: true,
 					},
+					&cli.BoolFlag{
+						Name:    "tty",
+						Aliases: []string{"t"},
+						Usage:   "allocate a pty for interactive commands",
+					},
+					&cli.BoolFlag{
+						Name:    "forward-agent",
+						Aliases: []string{"A"},
+						Usage:   "forward the local SSH agent",
+					},
+					&cli.StringSliceFlag{
+						Name:    "env",
+						Aliases: []string{"e"},
+						Usage:   "set `KEY=VAL` for the remote commands (can be specified multiple times)",
+					},
+					&cli.StringFlag{
+						Name:  "stdin-file",
+						Usage: "feed `FILE` to the command on stdin",
+					},
 				},
 				Action: execAction,
 			},
@@ -60,9 +113,136 @@ func main() {
 						Aliases: []string{"H"},
 						Usage:   "target host (can be specified multiple times)",
 					},
+					&cli.IntFlag{
+						Name:    "parallel",
+						Aliases: []string{"p"},
+						Usage:   "run on up to N hosts concurrently (overrides task config)",
+					},
+					&cli.StringSliceFlag{
+						Name:    "env",
+						Aliases: []string{"e"},
+						Usage:   "set `KEY=VAL` for the remote commands (can be specified multiple times)",
+					},
+					&cli.BoolFlag{
+						Name:    "ask-become-pass",
+						Aliases: []string{"K"},
+						Usage:   "prompt for the sudo password of become steps",
+					},
 				},
 				Action: runAction,
 			},
+			{
+				Name:      "ssh",
+				Usage:     "Open an interactive shell on a host",
+				ArgsUsage: "[host]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "workdir",
+						Aliases: []string{"w"},
+						Usage:   "start the shell in this directory",
+					},
+					&cli.StringFlag{
+						Name:    "task",
+						Aliases: []string{"T"},
+						Usage:   "start the shell in this task's workdir",
+					},
+					&cli.BoolFlag{
+						Name:    "forward-agent",
+						Aliases: []string{"A"},
+						Usage:   "forward the local SSH agent",
+					},
+				},
+				Action: sshAction,
+			},
+			{
+				Name:      "cp",
+				Usage:     "Copy files to or from a host over SFTP",
+				ArgsUsage: "[source] [destination]",
+				Description: "One of source and destination is host:path, the other a local path:\n" +
+					"  gosctl cp ./dist web1:/var/www/app\n" +
+					"  gosctl cp web1:/var/log/app.log .",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "recursive",
+						Aliases: []string{"r"},
+						Usage:   "copy directories recursively",
+					},
+					&cli.BoolFlag{
+						Name:    "preserve",
+						Aliases: []string{"p"},
+						Usage:   "preserve file modes and modification times",
+					},
+					&cli.BoolFlag{
+						Name:    "quiet",
+						Aliases: []string{"q"},
+						Usage:   "don't show progress",
+					},
+				},
+				Action: cpAction,
+			},
+			{
+				Name:      "sync",
+				Usage:     "Upload a directory to a host, copying only what changed",
+				ArgsUsage: "[local dir] [host:dir]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "delete",
+						Usage: "delete remote files that don't exist locally",
+					},
+					&cli.StringSliceFlag{
+						Name:    "exclude",
+						Aliases: []string{"x"},
+						Usage:   "skip paths matching `pattern` (can be specified multiple times)",
+					},
+					&cli.BoolFlag{
+						Name:  "checksum",
+						Usage: "compare file contents instead of size and modification time",
+					},
+				},
+				Action: syncAction,
+			},
+			{
+				Name:      "tunnel",
+				Usage:     "Forward ports through a host until interrupted",
+				ArgsUsage: "[tunnel...]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "host",
+						Aliases: []string{"H"},
+						Usage:   "host to forward through",
+					},
+					&cli.StringSliceFlag{
+						Name:    "local",
+						Aliases: []string{"L"},
+						Usage:   "forward local `[bind:]port:host:hostport` to host:hostport on the remote side",
+					},
+					&cli.StringSliceFlag{
+						Name:    "remote",
+						Aliases: []string{"R"},
+						Usage:   "forward remote `[bind:]port:host:hostport` to host:hostport on the local side",
+					},
+				},
+				Action: tunnelAction,
+			},
+			{
+				Name:  "proxy",
+				Usage: "Run a local SOCKS5 proxy that connects through a host",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "host",
+						Aliases:  []string{"H"},
+						Usage:    "host to connect through",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "listen",
+						Aliases: []string{"l"},
+						Usage:   "local address for the proxy",
+						Value:   "127.0.0.1:1080",
+					},
+				},
+				Action: proxyAction,
+			},
 			{
 				Name:   "hosts",
 				Usage:  "List configured hosts",
@@ -95,11 +275,6 @@ func main() {
 			},
 		},
 	}
-
-	if err := app.Run(context.Background(), os.Args); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
 }
 
 func execAction(ctx context.Context, cmd *cli.Command) error {
@@ -109,23 +284,290 @@ func execAction(ctx context.Context, cmd *cli.Command) error {
 	}
 
 	hostName := cmd.String("host")
-	host, ok := cfg.Hosts[hostName]
-	if !ok {
-		return errorf("host %q not found in config", hostName)
+	if _, err := cfg.LookupHost(hostName); err != nil {
+		return err
 	}
 
-	client, err := newSSHClient(host)
+	pool := newConnPool(cfg)
+	defer pool.Close()
+
+	client, err := pool.Get(ctx, hostName)
 	if err != nil {
 		return errorf("ssh connection failed: %w", err)
 	}
-	defer client.Close()
 
 	command := cmd.Args().First()
 	if command == "" {
 		return errorf("no command provided")
 	}
 
-	return client.Run(command)
+	env, err := parseEnvFlags(cmd.StringSlice("env"))
+	if err != nil {
+		return errorf("%v", err)
+	}
+
+	opts := RunOptions{
+		Stdout:       os.Stdout,
+		Stderr:       os.Stderr,
+		TTY:          cmd.Bool("tty"),
+		ForwardAgent: cmd.Bool("forward-agent"),
+		Env:          env,
+	}
+
+	// Piped stdin is passed through, a terminal only with --tty
+	if file := cmd.String("stdin-file"); file != "" {
+		if opts.TTY {
+			return errorf("--stdin-file can't be combined with --tty")
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return errorf("%v", err)
+		}
+		defer f.Close()
+		opts.Stdin = f
+	} else if !term.IsTerminal(int(os.Stdin.Fd())) {
+		opts.Stdin = os.Stdin
+	}
+
+	return client.Run(ctx, command, opts)
+}
+
+func sshAction(ctx context.Context, cmd *cli.Command) error {
+	cfg, err := loadConfig(cmd.String("config"), cmd.String("file"))
+	if err != nil {
+		return err
+	}
+
+	hostName := cmd.Args().First()
+	if hostName == "" {
+		return errorf("no host provided")
+	}
+	if _, err := cfg.LookupHost(hostName); err != nil {
+		return err
+	}
+
+	workdir := cmd.String("workdir")
+	if taskName := cmd.String("task"); taskName != "" {
+		if workdir != "" {
+			return errorf("use either --workdir or --task, not both")
+		}
+		task, ok := cfg.Tasks[taskName]
+		if !ok {
+			return configErrorf("task %q not found in config", taskName)
+		}
+		workdir = task.Workdir
+	}
+
+	pool := newConnPool(cfg)
+	defer pool.Close()
+
+	client, err := pool.Get(ctx, hostName)
+	if err != nil {
+		return errorf("ssh connection failed: %w", err)
+	}
+
+	return client.Shell(workdir, cmd.Bool("forward-agent"))
+}
+
+func cpAction(ctx context.Context, cmd *cli.Command) error {
+	cfg, err := loadConfig(cmd.String("config"), cmd.String("file"))
+	if err != nil {
+		return err
+	}
+
+	if cmd.Args().Len() != 2 {
+		return errorf("expected a source and a destination")
+	}
+	src, dst := cmd.Args().Get(0), cmd.Args().Get(1)
+
+	srcHost, srcPath, srcRemote := splitRemote(src)
+	dstHost, dstPath, dstRemote := splitRemote(dst)
+	if srcRemote == dstRemote {
+		return errorf("exactly one of source and destination must be host:path")
+	}
+	hostName := srcHost
+	if dstRemote {
+		hostName = dstHost
+	}
+	if _, err := cfg.LookupHost(hostName); err != nil {
+		return err
+	}
+
+	opts := copyOptions{
+		Recursive: cmd.Bool("recursive"),
+		Preserve:  cmd.Bool("preserve"),
+	}
+	if !cmd.Bool("quiet") && term.IsTerminal(int(os.Stderr.Fd())) {
+		opts.Progress = os.Stderr
+	}
+
+	pool := newConnPool(cfg)
+	defer pool.Close()
+
+	client, err := pool.Get(ctx, hostName)
+	if err != nil {
+		return errorf("ssh connection failed: %w", err)
+	}
+
+	if dstRemote {
+		err = client.Upload(ctx, src, dstPath, opts)
+	} else {
+		err = client.Download(ctx, srcPath, dst, opts)
+	}
+	if err != nil {
+		return errorf("copy failed: %w", err)
+	}
+	return nil
+}
+
+func syncAction(ctx context.Context, cmd *cli.Command) error {
+	cfg, err := loadConfig(cmd.String("config"), cmd.String("file"))
+	if err != nil {
+		return err
+	}
+
+	if cmd.Args().Len() != 2 {
+		return errorf("expected a local directory and host:dir")
+	}
+	src := cmd.Args().Get(0)
+	hostName, dst, ok := splitRemote(cmd.Args().Get(1))
+	if !ok {
+		return errorf("destination must be host:dir")
+	}
+	if _, err := cfg.LookupHost(hostName); err != nil {
+		return err
+	}
+
+	pool := newConnPool(cfg)
+	defer pool.Close()
+
+	client, err := pool.Get(ctx, hostName)
+	if err != nil {
+		return errorf("ssh connection failed: %w", err)
+	}
+
+	stats, err := client.Sync(ctx, src, dst, syncOptions{
+		Delete:   cmd.Bool("delete"),
+		Exclude:  cmd.StringSlice("exclude"),
+		Checksum: cmd.Bool("checksum"),
+		Log:      os.Stdout,
+	})
+	if err != nil {
+		return errorf("sync failed: %w", err)
+	}
+	printSuccess("Synced %s to %s: %s", src, hostName, stats)
+	return nil
+}
+
+func tunnelAction(ctx context.Context, cmd *cli.Command) error {
+	cfg, err := loadConfig(cmd.String("config"), cmd.String("file"))
+	if err != nil {
+		return err
+	}
+
+	// Named tunnels from the config, plus one from the command line
+	var tunnels []Tunnel
+	for _, name := range cmd.Args().Slice() {
+		tunnel, ok := cfg.Tunnels[name]
+		if !ok {
+			return configErrorf("tunnel %q not found in config", name)
+		}
+		if err := tunnel.Validate(name); err != nil {
+			return configErrorf("%v", err)
+		}
+		tunnels = append(tunnels, tunnel)
+	}
+	adhoc := Tunnel{Host: cmd.String("host"), Local: cmd.StringSlice("local"), Remote: cmd.StringSlice("remote")}
+	if adhoc.Host != "" || len(adhoc.Local) > 0 || len(adhoc.Remote) > 0 {
+		if adhoc.Host == "" {
+			return errorf("--local and --remote need --host")
+		}
+		if err := adhoc.Validate(adhoc.Host); err != nil {
+			return errorf("%v", err)
+		}
+		tunnels = append(tunnels, adhoc)
+	}
+	if len(tunnels) == 0 {
+		return errorf("no tunnel provided (name a tunnel or use --host with -L/-R)")
+	}
+
+	for _, tunnel := range tunnels {
+		if _, err := cfg.LookupHost(tunnel.Host); err != nil {
+			return err
+		}
+	}
+
+	pool := newConnPool(cfg)
+	defer pool.Close()
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var wg sync.WaitGroup
+	for _, tunnel := range tunnels {
+		client, err := pool.Get(ctx, tunnel.Host)
+		if err != nil {
+			cancel(nil)
+			wg.Wait()
+			return errorf("ssh connection to %s failed: %w", tunnel.Host, err)
+		}
+		local, remote, _ := tunnel.Forwards()
+		wg.Go(func() {
+			if err := runTunnel(ctx, client, tunnel.Host, local, remote); err != nil {
+				cancel(err)
+			}
+		})
+	}
+	fmt.Println("Press Ctrl-C to close the tunnel")
+
+	wg.Wait()
+	if err := context.Cause(ctx); err != nil && err != context.Canceled {
+		return errorf("%v", err)
+	}
+	return nil
+}
+
+func proxyAction(ctx context.Context, cmd *cli.Command) error {
+	cfg, err := loadConfig(cmd.String("config"), cmd.String("file"))
+	if err != nil {
+		return err
+	}
+
+	hostName := cmd.String("host")
+	if _, err := cfg.LookupHost(hostName); err != nil {
+		return err
+	}
+
+	pool := newConnPool(cfg)
+	defer pool.Close()
+
+	client, err := pool.Get(ctx, hostName)
+	if err != nil {
+		return errorf("ssh connection failed: %w", err)
+	}
+
+	ln, err := net.Listen("tcp", cmd.String("listen"))
+	if err != nil {
+		return errorf("%v", err)
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go func() {
+		client.client.Wait()
+		cancel(fmt.Errorf("connection to %s closed", hostName))
+	}()
+
+	printSuccess("SOCKS5 proxy on %s via %s", ln.Addr(), hostName)
+	fmt.Println("Press Ctrl-C to stop the proxy")
+
+	if err := serveSOCKS(ctx, ln, client.client.Dial); err != nil {
+		return errorf("%v", err)
+	}
+	if err := context.Cause(ctx); err != context.Canceled {
+		return errorf("%v", err)
+	}
+	return nil
 }
 
 func runAction(ctx context.Context, cmd *cli.Command) error {
@@ -141,17 +583,17 @@ func runAction(ctx context.Context, cmd *cli.Command) error {
 
 	task, ok := cfg.Tasks[taskName]
 	if !ok {
-		return errorf("task %q not found in config", taskName)
+		return configErrorf("task %q not found in config", taskName)
 	}
 
 	// Validate task config
 	if err := task.Validate(taskName); err != nil {
-		return errorf("%v", err)
+		return configErrorf("%v", err)
 	}
 
 	// Validate task references
 	if err := task.ValidateRefs(taskName, cfg.Tasks); err != nil {
-		return errorf("%v", err)
+		return configErrorf("%v", err)
 	}
 
 	// Use CLI hosts if provided, otherwise use task config
@@ -160,34 +602,74 @@ func runAction(ctx context.Context, cmd *cli.Command) error {
 		hostNames = task.GetHosts()
 	}
 
-	// Execute before tasks
-	for _, beforeName := range task.Before {
-		beforeTask := cfg.Tasks[beforeName]
-		if err := executeTask(cfg, beforeName, beforeTask, hostNames); err != nil {
-			return err
+	parallel := int(cmd.Int("parallel"))
+
+	// -e applies to every task of the run, on top of the task's env
+	env, err := parseEnvFlags(cmd.StringSlice("env"))
+	if err != nil {
+		return errorf("%v", err)
+	}
+
+	// Asked once for all tasks and hosts
+	var becomePassword string
+	if cmd.Bool("ask-become-pass") {
+		if becomePassword, err = readSecret(ctx, "BECOME password: "); err != nil {
+			return errorf("%v", err)
 		}
 	}
 
-	// Run main task on each host
-	for _, hostName := range hostNames {
-		host, ok := cfg.Hosts[hostName]
-		if !ok {
-			return errorf("host %q not found in config", hostName)
+	withFlags := func(t Task) Task {
+		t.Env = mergeMaps(t.Env, env)
+		t.becomePassword = becomePassword
+		return t
+	}
+	task = withFlags(task)
+
+	// Share one connection per host across before, main and after tasks
+	pool := newConnPool(cfg)
+	defer pool.Close()
+
+	runAfter := func(ctx context.Context) error {
+		for _, afterName := range task.After {
+			afterTask := withFlags(cfg.Tasks[afterName])
+			if err := executeTask(ctx, cfg, pool, afterName, afterTask, hostNames, parallel); err != nil {
+				return err
+			}
 		}
+		return nil
+	}
 
-		if err := runTaskOnHost(host, hostName, task, len(hostNames) > 1); err != nil {
+	// After tasks only run if everything before them succeeded, or if
+	// the run was interrupted: then they clean up with a fresh context,
+	// which a second Ctrl-C cancels
+	cleanup := func(err error) error {
+		if !errors.Is(err, errInterrupted) || len(task.After) == 0 {
 			return err
 		}
+		printWarning("Interrupted, running after tasks: %s (Ctrl-C again to abort)", strings.Join(task.After, ", "))
+		afterCtx, stop := notifyInterrupt(context.WithoutCancel(ctx))
+		defer stop()
+		return errors.Join(err, runAfter(afterCtx))
 	}
 
-	// Execute after tasks
-	for _, afterName := range task.After {
-		afterTask := cfg.Tasks[afterName]
-		if err := executeTask(cfg, afterName, afterTask, hostNames); err != nil {
-			return err
+	// Execute before tasks
+	for _, beforeName := range task.Before {
+		beforeTask := withFlags(cfg.Tasks[beforeName])
+		if err := executeTask(ctx, cfg, pool, beforeName, beforeTask, hostNames, parallel); err != nil {
+			return cleanup(err)
 		}
 	}
 
+	// Run main task on all hosts
+	if err := runOnHosts(ctx, cfg, pool, task, hostNames, task.Workers(len(hostNames), parallel)); err != nil {
+		return cleanup(err)
+	}
+
+	// Execute after tasks
+	if err := runAfter(ctx); err != nil {
+		return err
+	}
+
 	if len(hostNames) > 1 {
 		printSuccess("Task completed on %d hosts", len(hostNames))
 	} else {
@@ -197,7 +679,7 @@ func runAction(ctx context.Context, cmd *cli.Command) error {
 }
 
 // executeTask runs a referenced task (from before/after) with host mismatch warnings.
-func executeTask(cfg *Config, taskName string, task Task, parentHosts []string) error {
+func executeTask(ctx context.Context, cfg *Config, pool *connPool, taskName string, task Task, parentHosts []string, parallel int) error {
 	taskHosts := task.GetHosts()
 
 	// Check for host mismatch and warn
@@ -214,38 +696,35 @@ func executeTask(cfg *Config, taskName string, task Task, parentHosts []string)
 
 	printTaskHeader(taskName)
 
-	for _, hostName := range taskHosts {
-		host, ok := cfg.Hosts[hostName]
-		if !ok {
-			return errorf("host %q not found in config", hostName)
-		}
-
-		if err := runTaskOnHost(host, hostName, task, len(taskHosts) > 1); err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return runOnHosts(ctx, cfg, pool, task, taskHosts, task.Workers(len(taskHosts), parallel))
 }
 
-func runTaskOnHost(host Host, hostName string, task Task, showHostHeader bool) error {
+func runTaskOnHost(ctx context.Context, pool *connPool, hostName string, task Task, showHostHeader bool, stdout, stderr io.Writer) error {
+	if ctx.Err() != nil {
+		return errorf("%s %w before it started", hostName, errInterrupted)
+	}
 	if showHostHeader {
 		printHostHeader(hostName)
 	}
 
-	client, err := newSSHClient(host)
+	client, err := pool.Get(ctx, hostName)
+	if errors.Is(err, errInterrupted) {
+		return errorf("%s %w while connecting", hostName, errInterrupted)
+	}
 	if err != nil {
 		return errorf("ssh connection to %s failed: %w", hostName, err)
 	}
-	defer client.Close()
 
 	for i, step := range task.Steps {
-		cmd := step
-		if task.Workdir != "" {
-			cmd = fmt.Sprintf("cd %s && %s", task.Workdir, step)
+		if ctx.Err() != nil {
+			return errorf("%s %w before step %d", hostName, errInterrupted, i+1)
 		}
-		printStep(i+1, len(task.Steps), step, showHostHeader)
-		if err := client.Run(cmd); err != nil {
+		printStep(stdout, i+1, len(task.Steps), step.String(), showHostHeader)
+		opts := RunOptions{Stdout: stdout, Stderr: stderr, TTY: task.TTY, ForwardAgent: task.ForwardAgent, Env: task.Env}
+		if err := runStep(ctx, client, hostName, task, step, opts); err != nil {
+			if errors.Is(err, errInterrupted) {
+				return errorf("step %d on %s %w: %s", i+1, hostName, err, step)
+			}
 			return errorf("step %d on %s failed: %w", i+1, hostName, err)
 		}
 	}
@@ -265,11 +744,21 @@ func hostsAction(ctx context.Context, cmd *cli.Command) error {
 	for name, host := range cfg.Hosts {
 		source := cfg.HostSources[name]
 		override := source == "local (overrides global)"
-		printHost(name, host.User, host.Address, host.Port, source, override)
+		printHost(name, host.User, host.Address, host.Port, source, override, hostOrigins(host))
 	}
 	return nil
 }
 
+// hostOrigins describes which host values came from ~/.ssh/config, the
+// [defaults] section or built-in defaults rather than the host entry.
+func hostOrigins(host Host) string {
+	var parts []string
+	for _, key := range slices.Sorted(maps.Keys(host.Origins)) {
+		parts = append(parts, fmt.Sprintf("%s: %s", key, host.Origins[key]))
+	}
+	return strings.Join(parts, ", ")
+}
+
 func tasksAction(ctx context.Context, cmd *cli.Command) error {
 	cfg, err := loadConfig(cmd.String("config"), cmd.String("file"))
 	if err != nil {
@@ -428,10 +917,26 @@ func checkConfigAction(ctx context.Context, cmd *cli.Command) error {
 	// Check hosts
 	printSection("Hosts")
 	for name, host := range cfg.Hosts {
-		if host.Address == "" {
+		var issues []string
+
+		// Basic validation
+		if err := host.Validate(name); err != nil {
+			issues = append(issues, err.Error())
+		}
+
+		// Check jump host references and cycles
+		if _, err := cfg.Route(name); err != nil {
+			issues = append(issues, err.Error())
+		}
+
+		if len(issues) > 0 {
 			printInvalid(name)
-			printIssue("missing address")
+			for _, issue := range issues {
+				printIssue(issue)
+			}
 			hasErrors = true
+		} else if jumps := host.JumpHosts(); len(jumps) > 0 {
+			printValid("%s (%s@%s:%d via %s)", name, host.User, host.Address, host.Port, strings.Join(jumps, ", "))
 		} else {
 			printValid("%s (%s@%s:%d)", name, host.User, host.Address, host.Port)
 		}
@@ -455,7 +960,7 @@ func checkConfigAction(ctx context.Context, cmd *cli.Command) error {
 
 		// Check host references
 		for _, hostName := range task.GetHosts() {
-			if _, ok := cfg.Hosts[hostName]; !ok {
+			if _, ok := cfg.lookupHost(hostName); !ok {
 				issues = append(issues, fmt.Sprintf("host %q not found", hostName))
 			}
 		}
@@ -472,10 +977,38 @@ func checkConfigAction(ctx context.Context, cmd *cli.Command) error {
 		}
 	}
 
+	// Check tunnels
+	if len(cfg.Tunnels) > 0 {
+		fmt.Println()
+		printSection("Tunnels")
+	}
+	for name, tunnel := range cfg.Tunnels {
+		var issues []string
+
+		if err := tunnel.Validate(name); err != nil {
+			issues = append(issues, err.Error())
+		}
+		if tunnel.Host != "" {
+			if _, ok := cfg.lookupHost(tunnel.Host); !ok {
+				issues = append(issues, fmt.Sprintf("host %q not found", tunnel.Host))
+			}
+		}
+
+		if len(issues) > 0 {
+			printInvalid(name)
+			for _, issue := range issues {
+				printIssue(issue)
+			}
+			hasErrors = true
+		} else {
+			printValid("%s (via %s, local: %d, remote: %d)", name, tunnel.Host, len(tunnel.Local), len(tunnel.Remote))
+		}
+	}
+
 	fmt.Println()
 	if hasErrors {
 		printWarning("Configuration has errors")
-		return errorf("configuration validation failed")
+		return configErrorf("configuration validation failed")
 	}
 
 	printSuccess("Configuration OK")
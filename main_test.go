@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/axelrhd/gosctl/internal/sshtest"
+)
+
+// writeTestConfig writes a config with host web1 pointing at srv, followed
+// by tasks, and returns its path.
+func writeTestConfig(t *testing.T, srv *sshtest.Server, tasks string) string {
+	t.Helper()
+	host := testHost(t, srv)
+	host.Password = "secret"
+
+	config := fmt.Sprintf(`
+[hosts.web1]
+address = %q
+port = %d
+user = %q
+password = %q
+host_key = %q
+identities_only = %t
+keepalive_interval = %q
+%s`, host.Address, host.Port, host.User, host.Password, host.HostKey,
+		host.IdentitiesOnly, host.KeepaliveInterval, tasks)
+
+	path := filepath.Join(t.TempDir(), "sctl.toml")
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRunActionBeforeAfter(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Config{Password: "secret"})
+	path := writeTestConfig(t, srv, `
+[tasks.deploy]
+host = "web1"
+before = ["backup"]
+after = ["notify"]
+steps = ["echo deploy 1", "echo deploy 2"]
+
+[tasks.backup]
+host = "web1"
+steps = ["echo backup"]
+
+[tasks.notify]
+host = "web1"
+steps = ["echo notify"]
+
+[tasks.broken]
+host = "web1"
+steps = ["exit 4", "echo unreachable"]
+after = ["notify"]
+`)
+
+	if err := newApp().Run(context.Background(), []string{"gosctl", "-c", path, "run", "deploy"}); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	want := []string{"echo backup", "echo deploy 1", "echo deploy 2", "echo notify"}
+	if got := srv.Commands(); !slices.Equal(got, want) {
+		t.Errorf("expected commands %q, got %q", want, got)
+	}
+
+	// A failing step stops the task and skips the after tasks
+	err := newApp().Run(context.Background(), []string{"gosctl", "-c", path, "run", "broken"})
+	if code := exitCode(err); code != 4 {
+		t.Errorf("expected exit code 4, got %d (%v)", code, err)
+	}
+	want = append(want, "exit 4")
+	if got := srv.Commands(); !slices.Equal(got, want) {
+		t.Errorf("expected commands %q, got %q", want, got)
+	}
+
+	// An interrupted run still cleans up with its after tasks
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = newApp().Run(ctx, []string{"gosctl", "-c", path, "run", "deploy"})
+	if code := exitCode(err); code != exitInterrupt {
+		t.Errorf("expected exit code %d, got %d (%v)", exitInterrupt, code, err)
+	}
+	want = append(want, "echo notify")
+	if got := srv.Commands(); !slices.Equal(got, want) {
+		t.Errorf("expected commands %q, got %q", want, got)
+	}
+}
@@ -1,16 +1,26 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// outputMu serializes terminal output from concurrent hosts, so a warning
+// never lands in the middle of a host's line.
+var outputMu sync.Mutex
 
 // Output prefixes (ASCII for compatibility, emoji mapping in CLAUDE.md)
 const (
-	prefixHost    = "[H]"
-	prefixTask    = "[T]"
-	prefixStep    = ">"
-	prefixOK      = "[ok]"
-	prefixDone    = "[OK]"
-	prefixError   = "[error]"
-	prefixWarning = "[!]"
+	prefixHost     = "[H]"
+	prefixTask     = "[T]"
+	prefixStep     = ">"
+	prefixOK       = "[ok]"
+	prefixDone     = "[OK]"
+	prefixError    = "[error]"
+	prefixWarning  = "[!]"
 	prefixOverride = "*"
 )
 
@@ -19,12 +29,16 @@ func errorf(format string, a ...any) error {
 	return fmt.Errorf(prefixError+" "+format, a...)
 }
 
-// printHost prints a host entry.
-func printHost(name, user, address string, port int, source string, override bool) {
+// printHost prints a host entry. origins lists values that came from
+// somewhere other than the config file.
+func printHost(name, user, address string, port int, source string, override bool, origins string) {
+	if origins != "" {
+		origins = "  (" + origins + ")"
+	}
 	if override {
-		fmt.Printf("  %s %s -> %s@%s:%d  %s %s\n", prefixHost, name, user, address, port, prefixOverride, source)
+		fmt.Printf("  %s %s -> %s@%s:%d  %s %s%s\n", prefixHost, name, user, address, port, prefixOverride, source, origins)
 	} else {
-		fmt.Printf("  %s %s -> %s@%s:%d  [%s]\n", prefixHost, name, user, address, port, source)
+		fmt.Printf("  %s %s -> %s@%s:%d  [%s]%s\n", prefixHost, name, user, address, port, source, origins)
 	}
 }
 
@@ -48,12 +62,12 @@ func printHostHeader(name string) {
 }
 
 // printStep prints a step being executed.
-func printStep(current, total int, step string, indented bool) {
+func printStep(w io.Writer, current, total int, step string, indented bool) {
 	indent := "  "
 	if indented {
 		indent = "    "
 	}
-	fmt.Printf("%s%s [%d/%d] %s\n", indent, prefixStep, current, total, step)
+	fmt.Fprintf(w, "%s%s [%d/%d] %s\n", indent, prefixStep, current, total, step)
 }
 
 // printStepDone prints a completed host.
@@ -68,6 +82,8 @@ func printSuccess(format string, a ...any) {
 
 // printWarning prints a warning message.
 func printWarning(format string, a ...any) {
+	outputMu.Lock()
+	defer outputMu.Unlock()
 	fmt.Printf(prefixWarning+" "+format+"\n", a...)
 }
 
@@ -90,3 +106,20 @@ func printInvalid(name string) {
 func printIssue(issue string) {
 	fmt.Printf("      -> %s\n", issue)
 }
+
+// hostPrefix returns the line prefix used for a host's output during
+// parallel runs, padded to width so columns line up.
+func hostPrefix(name string, width int) string {
+	return fmt.Sprintf("%-*s | ", width, name)
+}
+
+// printHostResult prints one entry of the per-host summary.
+func printHostResult(name string, err error, d time.Duration) {
+	d = d.Round(100 * time.Millisecond)
+	if err == nil {
+		printValid("%s (%s)", name, d)
+		return
+	}
+	printInvalid(fmt.Sprintf("%s (%s)", name, d))
+	printIssue(strings.TrimPrefix(err.Error(), prefixError+" "))
+}
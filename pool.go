@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// connPool hands out one SSH connection per host for the duration of a
+// single command, so chained tasks on the same host share one handshake.
+type connPool struct {
+	cfg *Config
+
+	mu    sync.Mutex
+	conns map[string]*poolConn
+}
+
+type poolConn struct {
+	once   sync.Once
+	client *SSHClient
+	err    error
+}
+
+func newConnPool(cfg *Config) *connPool {
+	return &connPool{cfg: cfg, conns: make(map[string]*poolConn)}
+}
+
+// Get returns the connection for hostName, dialing it on first use.
+// Hosts behind jump hosts are tunneled through the pooled connections of
+// each hop. Concurrent callers for the same host wait for the same dial.
+// Cancelling ctx stops a dial in progress.
+func (p *connPool) Get(ctx context.Context, hostName string) (*SSHClient, error) {
+	route, err := p.cfg.routeHops(hostName)
+	if err != nil {
+		return nil, withExitCode(exitConfig, err)
+	}
+	names := hopNames(route)
+
+	var via *SSHClient
+	for i, hop := range route {
+		// Key by the full route so a host reached through different
+		// chains gets a connection per chain
+		key := strings.Join(names[:i+1], ",")
+		via, err = p.dial(ctx, key, hop.host, via)
+		if err != nil {
+			if i < len(route)-1 {
+				err = fmt.Errorf("jump host %s: %w", hop.name, err)
+			}
+			return nil, withExitCode(exitConnect, err)
+		}
+	}
+	return via, nil
+}
+
+func (p *connPool) dial(ctx context.Context, key string, host Host, via *SSHClient) (*SSHClient, error) {
+	p.mu.Lock()
+	conn, ok := p.conns[key]
+	if !ok {
+		conn = &poolConn{}
+		p.conns[key] = conn
+	}
+	p.mu.Unlock()
+
+	conn.once.Do(func() {
+		conn.client, conn.err = newSSHClient(ctx, host, via)
+	})
+	if errors.Is(conn.err, errInterrupted) {
+		// Let after tasks that run on a fresh context dial again
+		p.mu.Lock()
+		if p.conns[key] == conn {
+			delete(p.conns, key)
+		}
+		p.mu.Unlock()
+	}
+	return conn.client, conn.err
+}
+
+// Close closes every connection opened by the pool, tunneled connections
+// before the jump hosts they run through.
+func (p *connPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	keys := slices.Collect(maps.Keys(p.conns))
+	slices.SortFunc(keys, func(a, b string) int {
+		return strings.Count(b, ",") - strings.Count(a, ",")
+	})
+	for _, key := range keys {
+		if conn := p.conns[key]; conn.client != nil {
+			conn.client.Close()
+		}
+	}
+	p.conns = make(map[string]*poolConn)
+}
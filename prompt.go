@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+// promptMu serializes terminal prompts from concurrent hosts.
+var promptMu sync.Mutex
+
+// readSecret prompts on the controlling terminal and reads a line with
+// echo turned off. Cancelling ctx, e.g. with Ctrl-C, abandons the prompt.
+func readSecret(ctx context.Context, prompt string) (string, error) {
+	tty, err := openTTY()
+	if err != nil {
+		return "", err
+	}
+	defer tty.Close()
+
+	promptMu.Lock()
+	defer promptMu.Unlock()
+	return readSecretFrom(ctx, tty, prompt)
+}
+
+// readLine prompts on the controlling terminal and reads a line with
+// echo on. Cancelling ctx abandons the prompt.
+func readLine(ctx context.Context, prompt string) (string, error) {
+	tty, err := openTTY()
+	if err != nil {
+		return "", err
+	}
+	defer tty.Close()
+
+	promptMu.Lock()
+	defer promptMu.Unlock()
+	return readLineFrom(ctx, tty, prompt)
+}
+
+// openTTY opens the controlling terminal. Callers that ask several
+// questions in a row hold promptMu across them and use the From variants.
+func openTTY() (*os.File, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("no terminal available to prompt for input")
+	}
+	return tty, nil
+}
+
+// readSecretFrom is readSecret on an open terminal, with promptMu held.
+func readSecretFrom(ctx context.Context, tty *os.File, prompt string) (string, error) {
+	fmt.Fprint(tty, prompt)
+	return readTTY(ctx, tty, func() (string, error) {
+		secret, err := term.ReadPassword(int(tty.Fd()))
+		fmt.Fprintln(tty)
+		return string(secret), err
+	})
+}
+
+// readLineFrom is readLine on an open terminal, with promptMu held.
+func readLineFrom(ctx context.Context, tty *os.File, prompt string) (string, error) {
+	fmt.Fprint(tty, prompt)
+	return readTTY(ctx, tty, func() (string, error) {
+		line, err := bufio.NewReader(tty).ReadString('\n')
+		return strings.TrimRight(line, "\r\n"), err
+	})
+}
+
+// readTTY runs read until it returns or ctx is cancelled. Ctrl-C at a
+// prompt only cancels ctx, so without this the prompt would keep waiting
+// for an answer. On cancel the terminal is restored, echo included, and
+// the abandoned read is left to finish when the process exits.
+func readTTY(ctx context.Context, tty *os.File, read func() (string, error)) (string, error) {
+	state, _ := term.GetState(int(tty.Fd()))
+
+	type result struct {
+		line string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		line, err := read()
+		done <- result{line, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return "", r.err
+		}
+		return r.line, nil
+	case <-ctx.Done():
+		if state != nil {
+			term.Restore(int(tty.Fd()), state)
+		}
+		fmt.Fprintln(tty)
+		return "", errInterrupted
+	}
+}
+
+// confirm asks a yes/no question on the controlling terminal. Anything
+// but an explicit yes counts as no.
+func confirm(ctx context.Context, prompt string) (bool, error) {
+	answer, err := readLine(ctx, prompt)
+	if err != nil {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+// hasTTY reports whether there is a controlling terminal to prompt on.
+func hasTTY() bool {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	tty.Close()
+	return true
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// hostResult records the outcome of a task on a single host.
+type hostResult struct {
+	host     string
+	err      error
+	duration time.Duration
+}
+
+// runOnHosts runs task on every host, using up to workers concurrent
+// connections. Sequential runs stop at the first failing host; parallel
+// runs finish all hosts and print a per-host summary. Once ctx is
+// cancelled, no new hosts are started.
+func runOnHosts(ctx context.Context, cfg *Config, pool *connPool, task Task, hostNames []string, workers int) error {
+	// Check all hosts up front so a typo fails before anything runs
+	for _, name := range hostNames {
+		if _, err := cfg.LookupHost(name); err != nil {
+			return err
+		}
+	}
+
+	// A pty needs the local terminal to itself
+	if task.TTY && workers > 1 {
+		printWarning("Task uses a tty, running hosts sequentially")
+		workers = 1
+	}
+
+	if workers <= 1 {
+		for _, name := range hostNames {
+			if err := runTaskOnHost(ctx, pool, name, task, len(hostNames) > 1, os.Stdout, os.Stderr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	width := 0
+	for _, name := range hostNames {
+		width = max(width, len(name))
+	}
+
+	var (
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, workers)
+		results = make([]hostResult, len(hostNames))
+	)
+	for i, name := range hostNames {
+		wg.Go(func() {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				results[i] = hostResult{host: name, err: errorf("%s %w before it started", name, errInterrupted)}
+				return
+			}
+
+			prefix := hostPrefix(name, width)
+			stdout := &lineWriter{w: os.Stdout, mu: &outputMu, prefix: prefix}
+			stderr := &lineWriter{w: os.Stderr, mu: &outputMu, prefix: prefix}
+
+			start := time.Now()
+			err := runTaskOnHost(ctx, pool, name, task, false, stdout, stderr)
+			stdout.Flush()
+			stderr.Flush()
+			results[i] = hostResult{host: name, err: err, duration: time.Since(start)}
+		})
+	}
+	wg.Wait()
+
+	printSection("Summary")
+	failed, interrupted := 0, 0
+	for _, r := range results {
+		printHostResult(r.host, r.err, r.duration)
+		switch {
+		case errors.Is(r.err, errInterrupted):
+			interrupted++
+		case r.err != nil:
+			failed++
+		}
+	}
+	if interrupted > 0 {
+		return errorf("task %w on %d of %d hosts", errInterrupted, interrupted, len(hostNames))
+	}
+	if failed > 0 {
+		return errorf("task failed on %d of %d hosts", failed, len(hostNames))
+	}
+	return nil
+}
+
+// lineWriter buffers output and writes it one complete line at a time,
+// prefixed with the host name, so concurrent hosts never interleave mid-line.
+type lineWriter struct {
+	w      io.Writer
+	mu     *sync.Mutex
+	prefix string
+	buf    []byte
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.buf = append(lw.buf, p...)
+	for {
+		i := bytes.IndexByte(lw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		lw.emit(lw.buf[:i+1])
+		lw.buf = lw.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush writes any trailing partial line.
+func (lw *lineWriter) Flush() {
+	if len(lw.buf) > 0 {
+		lw.emit(append(lw.buf, '\n'))
+		lw.buf = nil
+	}
+}
+
+// emit writes the prefix and line with a single Write.
+func (lw *lineWriter) emit(line []byte) {
+	out := make([]byte, 0, len(lw.prefix)+len(line))
+	out = append(append(out, lw.prefix...), line...)
+
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.w.Write(out)
+}
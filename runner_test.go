@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/axelrhd/gosctl/internal/sshtest"
+)
+
+func TestRunOnHostsInterrupted(t *testing.T) {
+	cfg := &Config{Hosts: map[string]Host{
+		// Unroutable, so any attempt to connect would fail differently
+		"web1": {Address: "192.0.2.1", User: "deploy"},
+		"web2": {Address: "192.0.2.2", User: "deploy"},
+	}}
+	pool := newConnPool(cfg)
+	defer pool.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	task := Task{Steps: []Step{{Run: "uptime"}}}
+	for _, workers := range []int{1, 2} {
+		err := runOnHosts(ctx, cfg, pool, task, []string{"web1", "web2"}, workers)
+		if !errors.Is(err, errInterrupted) {
+			t.Errorf("workers=%d: expected interrupted error, got %v", workers, err)
+		}
+	}
+}
+
+func TestRunTaskOnHostWorkdir(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Config{Password: "secret"})
+	host := testHost(t, srv)
+	host.Password = "secret"
+	cfg := &Config{Hosts: map[string]Host{"web1": host}}
+	pool := newConnPool(cfg)
+	defer pool.Close()
+
+	workdir := t.TempDir()
+	local := filepath.Join(t.TempDir(), "app.conf")
+	if err := os.WriteFile(local, []byte("port = 8080\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	task := Task{
+		Workdir: workdir,
+		Steps: []Step{
+			{Run: "pwd"},
+			{Upload: local, To: "app.conf"},
+			{Run: "cat", Input: "from input\n"},
+		},
+	}
+
+	var stdout, stderr bytes.Buffer
+	if err := runTaskOnHost(context.Background(), pool, "web1", task, false, &stdout, &stderr); err != nil {
+		t.Fatalf("runTaskOnHost failed: %v\n%s", err, stderr.String())
+	}
+
+	want := []string{"cd " + workdir + " && pwd", "cd " + workdir + " && cat"}
+	if got := srv.Commands(); !slices.Equal(got, want) {
+		t.Errorf("expected commands %q, got %q", want, got)
+	}
+	if !strings.Contains(stdout.String(), workdir+"\n") || !strings.Contains(stdout.String(), "from input\n") {
+		t.Errorf("unexpected output:\n%s", stdout.String())
+	}
+	// Relative upload targets are relative to the workdir
+	if data, err := os.ReadFile(filepath.Join(workdir, "app.conf")); err != nil || string(data) != "port = 8080\n" {
+		t.Errorf("expected upload into workdir, got %q, %v", data, err)
+	}
+}
+
+// writeRecorder records each Write separately.
+type writeRecorder struct{ writes []string }
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, string(p))
+	return len(p), nil
+}
+
+func TestLineWriter(t *testing.T) {
+	var mu sync.Mutex
+	rec := &writeRecorder{}
+	lw := &lineWriter{w: rec, mu: &mu, prefix: "web1 | "}
+
+	io.WriteString(lw, "one\ntw")
+	io.WriteString(lw, "o\nthree")
+	lw.Flush()
+
+	// Prefix and line go out together, so nothing can land between them
+	want := []string{"web1 | one\n", "web1 | two\n", "web1 | three\n"}
+	if !slices.Equal(rec.writes, want) {
+		t.Errorf("expected writes %q, got %q", want, rec.writes)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol values (RFC 1928) used by the proxy. Only the CONNECT
+// command without authentication is supported, which is what ssh -D
+// offers too.
+const (
+	socksVersion     = 5
+	socksNoAuth      = 0x00
+	socksNoMethod    = 0xff
+	socksCmdConnect  = 0x01
+	socksAddrIPv4    = 0x01
+	socksAddrDomain  = 0x03
+	socksAddrIPv6    = 0x04
+	socksOK          = 0x00
+	socksUnreachable = 0x04
+	socksBadCommand  = 0x07
+	socksBadAddrType = 0x08
+)
+
+// socksHandshakeTimeout bounds how long a client may take to send its
+// request, so idle connections don't pile up.
+const socksHandshakeTimeout = 30 * time.Second
+
+// serveSOCKS runs a SOCKS5 server on ln until ctx is done, opening each
+// requested connection with dial.
+func serveSOCKS(ctx context.Context, ln net.Listener, dial dialer) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			target, err := socksConnect(conn, dial)
+			if err != nil {
+				printWarning("SOCKS %s: %v", conn.RemoteAddr(), err)
+				return
+			}
+			defer target.Close()
+			relay(conn, target)
+		}()
+	}
+}
+
+// socksConnect reads a client's greeting and CONNECT request, dials the
+// target and sends the reply. The returned connection is ready to relay.
+func socksConnect(conn net.Conn, dial dialer) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	// Greeting: version, number of auth methods, methods
+	var head [2]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return nil, err
+	}
+	if head[0] != socksVersion {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+	method := byte(socksNoMethod)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return nil, err
+	}
+	if method == socksNoMethod {
+		return nil, errors.New("client requires authentication")
+	}
+
+	// Request: version, command, reserved, address type, address, port
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return nil, err
+	}
+	if req[1] != socksCmdConnect {
+		socksReply(conn, socksBadCommand)
+		return nil, fmt.Errorf("unsupported SOCKS command %d", req[1])
+	}
+
+	var host string
+	switch req[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		size := net.IPv4len
+		if req[3] == socksAddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, err
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return nil, err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return nil, err
+		}
+		host = string(name)
+	default:
+		socksReply(conn, socksBadAddrType)
+		return nil, fmt.Errorf("unsupported SOCKS address type %d", req[3])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+
+	target, err := dial("tcp", addr)
+	if err != nil {
+		socksReply(conn, socksUnreachable)
+		return nil, fmt.Errorf("connect to %s: %w", addr, err)
+	}
+	if err := socksReply(conn, socksOK); err != nil {
+		target.Close()
+		return nil, err
+	}
+	return target, nil
+}
+
+// socksReply sends a reply with the given status. The bound address is
+// always reported as 0.0.0.0:0; clients don't need it for CONNECT.
+func socksReply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{socksVersion, status, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSOCKSConnect(t *testing.T) {
+	// Echo server as the target
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dialed := make(chan string, 1)
+	go serveSOCKS(ctx, ln, func(network, addr string) (net.Conn, error) {
+		dialed <- addr
+		return net.Dial(network, echo.Addr().String())
+	})
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Greeting with "no auth", then CONNECT to example.internal:80
+	conn.Write([]byte{socksVersion, 1, socksNoAuth})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != socksNoAuth {
+		t.Fatalf("greeting reply %v, %v", reply, err)
+	}
+	name := "example.internal"
+	req := append([]byte{socksVersion, socksCmdConnect, 0, socksAddrDomain, byte(len(name))}, name...)
+	conn.Write(append(req, 0, 80))
+	reply = make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != socksOK {
+		t.Fatalf("connect reply %v, %v", reply, err)
+	}
+	if addr := <-dialed; addr != "example.internal:80" {
+		t.Errorf("expected to dial example.internal:80, got %q", addr)
+	}
+
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("expected echoed ping, got %q, %v", buf, err)
+	}
+}
+
+func TestSOCKSUnsupportedCommand(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		server, err := ln.Accept()
+		if err != nil {
+			errc <- err
+			return
+		}
+		_, err = socksConnect(server, net.Dial)
+		server.Close()
+		errc <- err
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	client.Write([]byte{socksVersion, 1, socksNoAuth})
+	io.ReadFull(client, make([]byte, 2))
+	// BIND is not supported
+	client.Write([]byte{socksVersion, 0x02, 0, socksAddrIPv4, 127, 0, 0, 1, 0, 80})
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil || reply[1] != socksBadCommand {
+		t.Errorf("expected command not supported reply, got %v, %v", reply, err)
+	}
+	if err := <-errc; err == nil {
+		t.Error("expected error for unsupported command")
+	}
+}
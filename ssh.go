@@ -1,46 +1,118 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"net"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
-	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Auth method names for auth_methods, as used in the SSH protocol.
+const (
+	authPublicKey           = "publickey"
+	authPassword            = "password"
+	authKeyboardInteractive = "keyboard-interactive"
+)
+
+// Connection defaults for hosts that don't set them.
+const (
+	defaultConnectTimeout    = 10 * time.Second
+	defaultKeepaliveInterval = 30 * time.Second
+	defaultRetryBackoff      = time.Second
+
+	// keepaliveMaxMissed is how many intervals a keepalive may go
+	// unanswered before the host is considered dead.
+	keepaliveMaxMissed = 3
+
+	// interruptGrace is how long an interrupted command gets to exit after
+	// SIGINT before its session is closed.
+	interruptGrace = 5 * time.Second
 )
 
 type SSHClient struct {
 	client    *ssh.Client
 	host      Host
 	agentConn net.Conn
+	closed    chan struct{}
+
+	sftpOnce sync.Once
+	sftp     *sftp.Client
+	sftpErr  error
+
+	forwardOnce sync.Once
+	forwardErr  error
+
+	becomeOnce sync.Once
+	becomePass string
+	becomeErr  error
+
+	// Set once the server rejected a SetEnv request, so later commands go
+	// straight to exporting variables inline
+	setenvRejected atomic.Bool
 }
 
-func newSSHClient(host Host) (*SSHClient, error) {
-	authMethods, agentConn := buildAuthMethods(host)
+// newSSHClient connects to host, tunneling through via if it is not nil.
+// Cancelling ctx stops the dial, retries and any prompts for it.
+func newSSHClient(ctx context.Context, host Host, via *SSHClient) (*SSHClient, error) {
+	authMethods, agentConn := buildAuthMethods(ctx, host)
 	if len(authMethods) == 0 {
 		return nil, fmt.Errorf("no authentication methods available")
 	}
 
-	hostKeyCallback, err := buildHostKeyCallback()
+	hostKeyCallback, hostKeyAlgorithms, err := buildHostKeyCallback(ctx, host)
 	if err != nil {
 		if agentConn != nil {
 			agentConn.Close()
 		}
-		return nil, fmt.Errorf("failed to load known_hosts: %w (add host with: ssh-keyscan -H %s >> ~/.ssh/known_hosts)", err, host.Address)
+		return nil, err
 	}
 
+	timeout := time.Duration(host.ConnectTimeout)
+	if timeout == 0 {
+		timeout = defaultConnectTimeout
+	}
 	config := &ssh.ClientConfig{
-		User:            host.User,
-		Auth:            authMethods,
-		HostKeyCallback: hostKeyCallback,
-		Timeout:         10 * time.Second,
+		User:              host.User,
+		Auth:              authMethods,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgorithms,
+		Timeout:           timeout,
 	}
 
+	backoff := time.Duration(host.RetryBackoff)
+	if backoff == 0 {
+		backoff = defaultRetryBackoff
+	}
 	addr := fmt.Sprintf("%s:%d", host.Address, host.Port)
-	client, err := ssh.Dial("tcp", addr, config)
+	var client *ssh.Client
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		client, retry, err = dial(ctx, via, addr, config)
+		if err == nil || !retry || attempt >= host.ConnectRetries {
+			break
+		}
+		printWarning("Connecting to %s failed: %v (retrying in %s)", addr, err, backoff)
+		// The next dial returns errInterrupted if ctx was cancelled
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		backoff *= 2
+	}
 	if err != nil {
 		if agentConn != nil {
 			agentConn.Close()
@@ -48,48 +120,251 @@ func newSSHClient(host Host) (*SSHClient, error) {
 		return nil, err
 	}
 
-	return &SSHClient{client: client, host: host, agentConn: agentConn}, nil
+	c := &SSHClient{client: client, host: host, agentConn: agentConn, closed: make(chan struct{})}
+	if interval := time.Duration(host.KeepaliveInterval); interval >= 0 {
+		if interval == 0 {
+			interval = defaultKeepaliveInterval
+		}
+		go c.keepalive(interval)
+	}
+	return c, nil
 }
 
-func buildAuthMethods(host Host) ([]ssh.AuthMethod, net.Conn) {
-	var methods []ssh.AuthMethod
-	var agentConn net.Conn
+// dial connects to addr, directly or through via, and runs the SSH
+// handshake. config.Timeout bounds the TCP connect and the key exchange,
+// so a host that accepts connections but never answers doesn't hang the
+// run; authentication prompts are not cut short. retry reports whether
+// the failure was a connection problem worth another attempt, as opposed
+// to a rejected host key or failed authentication. Cancelling ctx closes
+// the connection, ending the handshake with errInterrupted.
+func dial(ctx context.Context, via *SSHClient, addr string, config *ssh.ClientConfig) (client *ssh.Client, retry bool, err error) {
+	var conn net.Conn
+	if via != nil {
+		conn, err = via.client.DialContext(ctx, "tcp", addr)
+	} else {
+		d := net.Dialer{Timeout: config.Timeout}
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	}
+	if ctx.Err() != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, false, errInterrupted
+	}
+	if err != nil {
+		return nil, true, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(config.Timeout, func() {
+		timedOut.Store(true)
+		conn.Close()
+	})
+	defer timer.Stop()
+
+	handshake := *config
+	handshake.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		// The server answered the key exchange; it's alive
+		if !timer.Stop() {
+			return fmt.Errorf("connection timed out")
+		}
+		return config.HostKeyCallback(hostname, remote, key)
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, &handshake)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, false, errInterrupted
+		}
+		if timedOut.Load() {
+			return nil, true, fmt.Errorf("ssh: handshake with %s timed out after %s", addr, config.Timeout)
+		}
+		return nil, errors.Is(err, io.EOF), err
+	}
+	return ssh.NewClient(c, chans, reqs), false, nil
+}
 
-	// 1. Try SSH agent first
-	if auth, conn := sshAgentAuth(); auth != nil {
-		methods = append(methods, auth)
-		agentConn = conn
+// keepalive sends keepalive requests every interval and closes the
+// connection if the host stops answering, so sessions on a dead host fail
+// instead of hanging.
+func (c *SSHClient) keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := c.client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+
+		select {
+		case err := <-reply:
+			if err != nil {
+				return
+			}
+		case <-c.closed:
+			return
+		case <-time.After(keepaliveMaxMissed * interval):
+			printWarning("%s@%s not responding for %s, closing connection",
+				c.host.User, c.host.Address, keepaliveMaxMissed*interval)
+			c.client.Close()
+			return
+		}
 	}
+}
+
+// buildAuthMethods returns the available auth methods in the order given
+// by the host's auth_methods, or publickey, password, keyboard-interactive.
+func buildAuthMethods(ctx context.Context, host Host) ([]ssh.AuthMethod, net.Conn) {
+	available := make(map[string]ssh.AuthMethod)
 
-	// 2. Try specific key file if configured
+	// 1. Public keys: SSH agent first, then the configured key file and
+	// the default key locations. They are offered as a single method
+	// because the ssh package only tries the first method of each type.
+	agentClient, agentConn := sshAgent()
+
+	var keyPaths []string
 	if host.KeyFile != "" {
-		if keyAuth := publicKeyAuth(host.KeyFile); keyAuth != nil {
-			methods = append(methods, keyAuth)
+		keyPaths = append(keyPaths, host.KeyFile)
+	}
+	if !host.IdentitiesOnly {
+		home, _ := os.UserHomeDir()
+		for _, name := range []string{"id_ed25519", "id_rsa", "id_ecdsa"} {
+			if keyPath := filepath.Join(home, ".ssh", name); keyPath != host.KeyFile {
+				keyPaths = append(keyPaths, keyPath)
+			}
 		}
 	}
 
-	// 3. Try default key locations
-	home, _ := os.UserHomeDir()
-	defaultKeys := []string{
-		filepath.Join(home, ".ssh", "id_ed25519"),
-		filepath.Join(home, ".ssh", "id_rsa"),
-		filepath.Join(home, ".ssh", "id_ecdsa"),
+	var keySigners []ssh.Signer
+	for _, keyPath := range keyPaths {
+		if signer := publicKeySigner(ctx, keyPath, host.PassphraseCmd); signer != nil {
+			keySigners = append(keySigners, signer)
+		}
+	}
+
+	// User certificates: cert_file plus any <key>-cert.pub next to the
+	// keys above. They are matched to agent or file keys when offered.
+	certPaths := []string{host.CertFile}
+	for _, keyPath := range keyPaths {
+		certPaths = append(certPaths, keyPath+"-cert.pub")
 	}
-	for _, keyPath := range defaultKeys {
-		if keyAuth := publicKeyAuth(keyPath); keyAuth != nil {
-			methods = append(methods, keyAuth)
+	var certs []*ssh.Certificate
+	for _, certPath := range certPaths {
+		if certPath == "" {
+			continue
+		}
+		cert, err := readCertificate(certPath)
+		if err != nil {
+			if certPath == host.CertFile {
+				printWarning("Skipping cert_file %s: %v", certPath, err)
+			}
+			continue
 		}
+		certs = append(certs, cert)
 	}
 
-	// 4. Password as fallback
+	if agentClient != nil || len(keySigners) > 0 {
+		available[authPublicKey] = ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			signers := agentSigners(agentClient, host)
+			for _, signer := range keySigners {
+				if !hasPublicKey(signers, signer.PublicKey()) {
+					signers = append(signers, signer)
+				}
+			}
+			return withCertificates(signers, certs), nil
+		})
+	}
+
+	// 2. Password
 	if host.Password != "" {
-		methods = append(methods, ssh.Password(host.Password))
+		available[authPassword] = ssh.Password(host.Password)
+	}
+
+	// 3. Keyboard-interactive challenges, e.g. a one-time code after a key.
+	// Only offered by default if someone can answer them.
+	if slices.Contains(host.AuthMethods, authKeyboardInteractive) || host.Password != "" || hasTTY() {
+		available[authKeyboardInteractive] = ssh.KeyboardInteractive(keyboardInteractive(ctx, host))
+	}
+
+	order := host.AuthMethods
+	if len(order) == 0 {
+		order = []string{authPublicKey, authPassword, authKeyboardInteractive}
+	}
+	var methods []ssh.AuthMethod
+	for _, name := range order {
+		if method, ok := available[name]; ok {
+			methods = append(methods, method)
+		}
 	}
 
 	return methods, agentConn
 }
 
-func sshAgentAuth() (ssh.AuthMethod, net.Conn) {
+// keyboardInteractive answers the server's challenges on the terminal.
+// Password questions are answered with the configured password, if any.
+// The terminal is held for the whole challenge, so prompts from other
+// hosts don't land between its banner and questions.
+func keyboardInteractive(ctx context.Context, host Host) ssh.KeyboardInteractiveChallenge {
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		if len(questions) == 0 {
+			return nil, nil
+		}
+
+		answers := make([]string, len(questions))
+		var ask []int
+		for i, question := range questions {
+			if !echos[i] && host.Password != "" && strings.Contains(strings.ToLower(question), "password") {
+				answers[i] = host.Password
+				continue
+			}
+			ask = append(ask, i)
+		}
+		if len(ask) == 0 {
+			return answers, nil
+		}
+
+		tty, err := openTTY()
+		if err != nil {
+			return nil, err
+		}
+		defer tty.Close()
+
+		promptMu.Lock()
+		defer promptMu.Unlock()
+
+		if name != "" || instruction != "" {
+			if _, err := fmt.Fprintln(tty, strings.TrimSpace(name+"\n"+instruction)); err != nil {
+				return nil, err
+			}
+		}
+		for _, i := range ask {
+			prompt := fmt.Sprintf("(%s@%s) %s", host.User, host.Address, questions[i])
+			if echos[i] {
+				answers[i], err = readLineFrom(ctx, tty, prompt)
+			} else {
+				answers[i], err = readSecretFrom(ctx, tty, prompt)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return answers, nil
+	}
+}
+
+// sshAgent connects to the SSH agent, if one is running.
+func sshAgent() (agent.ExtendedAgent, net.Conn) {
 	socket := os.Getenv("SSH_AUTH_SOCK")
 	if socket == "" {
 		return nil, nil
@@ -100,50 +375,251 @@ func sshAgentAuth() (ssh.AuthMethod, net.Conn) {
 		return nil, nil
 	}
 
-	agentClient := agent.NewClient(conn)
-	return ssh.PublicKeysCallback(agentClient.Signers), conn
+	return agent.NewClient(conn), conn
 }
 
-func publicKeyAuth(keyPath string) ssh.AuthMethod {
-	key, err := os.ReadFile(keyPath)
+// agentSigners returns the keys held by the SSH agent. With
+// identities_only, only the agent key matching the host's key file (via
+// its .pub) is used.
+func agentSigners(agentClient agent.ExtendedAgent, host Host) []ssh.Signer {
+	if agentClient == nil {
+		return nil
+	}
+	signers, err := agentClient.Signers()
 	if err != nil {
 		return nil
 	}
+	if !host.IdentitiesOnly {
+		return signers
+	}
 
-	signer, err := ssh.ParsePrivateKey(key)
+	pub, err := readPublicKey(host.KeyFile + ".pub")
 	if err != nil {
-		// Try with empty passphrase - if key is encrypted, this will fail
-		// Could add interactive passphrase prompt here later
 		return nil
 	}
+	var matching []ssh.Signer
+	for _, signer := range signers {
+		if bytes.Equal(signer.PublicKey().Marshal(), pub.Marshal()) {
+			matching = append(matching, signer)
+		}
+	}
+	return matching
+}
 
-	return ssh.PublicKeys(signer)
+func hasPublicKey(signers []ssh.Signer, pub ssh.PublicKey) bool {
+	for _, signer := range signers {
+		if bytes.Equal(signer.PublicKey().Marshal(), pub.Marshal()) {
+			return true
+		}
+	}
+	return false
 }
 
-func buildHostKeyCallback() (ssh.HostKeyCallback, error) {
-	home, err := os.UserHomeDir()
+// RunOptions controls how a remote command is run.
+type RunOptions struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// TTY requests a pty sized to the local terminal and forwards stdin,
+	// for interactive programs, password prompts and colored output.
+	// Stdin is ignored then.
+	TTY bool
+
+	// ForwardAgent makes the local SSH agent available to the command,
+	// as with ssh -A. Hosts with forward_agent always forward it.
+	ForwardAgent bool
+
+	// Env is set for the command on top of the host's env.
+	Env map[string]string
+
+	// Become runs the command as another user, e.g. with sudo.
+	Become *become
+}
+
+// errInterrupted is returned by Run, transfers and dials when their
+// context is cancelled before they finished.
+var errInterrupted = errors.New("interrupted")
+
+// Run runs command on the host. If ctx is cancelled while it runs, the
+// command gets SIGINT and, if it hasn't exited after interruptGrace, its
+// session is closed.
+func (c *SSHClient) Run(ctx context.Context, command string, opts RunOptions) error {
+	session, err := c.client.NewSession()
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer session.Close()
 
-	knownHostsPath := filepath.Join(home, ".ssh", "known_hosts")
-	return knownhosts.New(knownHostsPath)
+	if opts.ForwardAgent || c.host.ForwardAgent {
+		if err := c.forwardAgent(session); err != nil {
+			return err
+		}
+	}
+
+	env := mergeMaps(c.host.Env, opts.Env)
+	session.Stdin = opts.Stdin
+	session.Stdout = opts.Stdout
+	session.Stderr = opts.Stderr
+
+	var feeder *passwordFeeder
+	if opts.Become != nil {
+		b := *opts.Become
+		if b.feedsPassword(opts.TTY) {
+			session.Stdin = nil
+			stdin, err := session.StdinPipe()
+			if err != nil {
+				return err
+			}
+			b = b.withMarker()
+			feeder = newPasswordFeeder(b, stdin, opts.Stdin, opts.Stderr)
+			session.Stderr = feeder
+		}
+		// sudo and friends reset the environment, so it is exported
+		// inside the wrapped command
+		exported, err := exportEnv(env, command)
+		if err != nil {
+			return err
+		}
+		command = b.wrap(exported, opts.TTY)
+	} else {
+		if command, err = c.setEnv(session, env, command); err != nil {
+			return err
+		}
+	}
+
+	if opts.TTY {
+		restore, err := startTTY(session)
+		if err != nil {
+			return err
+		}
+		defer restore()
+	}
+
+	if err := session.Start(command); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		err := session.Wait()
+		if feeder != nil {
+			feeder.flush()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+	session.Signal(ssh.SIGINT)
+	select {
+	case <-done:
+	case <-time.After(interruptGrace):
+		session.Close()
+	}
+	return errInterrupted
 }
 
-func (c *SSHClient) Run(command string) error {
+// Shell starts an interactive login shell on a pty, in workdir if set.
+func (c *SSHClient) Shell(workdir string, forwardAgent bool) error {
 	session, err := c.client.NewSession()
 	if err != nil {
 		return err
 	}
 	defer session.Close()
 
+	if forwardAgent || c.host.ForwardAgent {
+		if err := c.forwardAgent(session); err != nil {
+			return err
+		}
+	}
+
 	session.Stdout = os.Stdout
 	session.Stderr = os.Stderr
 
-	return session.Run(command)
+	restore, err := startTTY(session)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	if workdir == "" {
+		err = session.Shell()
+	} else {
+		err = session.Start(fmt.Sprintf("cd %s && exec \"$SHELL\" -l", workdir))
+	}
+	if err != nil {
+		return err
+	}
+	return session.Wait()
+}
+
+// setEnv sets env on session and returns the command to run. Most servers
+// only accept a few variables (AcceptEnv in sshd_config); the rest are
+// exported inline in front of the command instead.
+func (c *SSHClient) setEnv(session *ssh.Session, env map[string]string, command string) (string, error) {
+	rejected := make(map[string]string)
+	for _, key := range slices.Sorted(maps.Keys(env)) {
+		if !c.setenvRejected.Load() {
+			if err := session.Setenv(key, env[key]); err == nil {
+				continue
+			}
+			c.setenvRejected.Store(true)
+		}
+		rejected[key] = env[key]
+	}
+	return exportEnv(rejected, command)
+}
+
+// exportEnv prefixes command with an export of env. Names go into the
+// command unquoted, so invalid ones are an error.
+func exportEnv(env map[string]string, command string) (string, error) {
+	if err := validateEnv(env); err != nil {
+		return "", err
+	}
+	if len(env) == 0 {
+		return command, nil
+	}
+	var exports []string
+	for _, key := range slices.Sorted(maps.Keys(env)) {
+		exports = append(exports, key+"="+shellQuote(env[key]))
+	}
+	return "export " + strings.Join(exports, " ") + "; " + command, nil
+}
+
+// forwardAgent requests agent forwarding for session. Agent requests from
+// the host are served by the local agent over the connection opened for
+// authentication.
+func (c *SSHClient) forwardAgent(session *ssh.Session) error {
+	c.forwardOnce.Do(func() {
+		if c.agentConn == nil {
+			c.forwardErr = fmt.Errorf("agent forwarding needs a running SSH agent (SSH_AUTH_SOCK)")
+			return
+		}
+		c.forwardErr = agent.ForwardToAgent(c.client, agent.NewClient(c.agentConn))
+	})
+	if c.forwardErr != nil {
+		return c.forwardErr
+	}
+	return agent.RequestAgentForwarding(session)
+}
+
+// shellQuote quotes s as a single word for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
 }
 
 func (c *SSHClient) Close() error {
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	if c.sftp != nil {
+		c.sftp.Close()
+	}
 	if c.agentConn != nil {
 		c.agentConn.Close()
 	}
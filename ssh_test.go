@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/axelrhd/gosctl/internal/sshtest"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestDialHandshakeTimeout(t *testing.T) {
+	// A server that accepts connections but never speaks SSH
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	config := &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         200 * time.Millisecond,
+	}
+
+	start := time.Now()
+	_, retry, err := dial(context.Background(), nil, ln.Addr().String(), config)
+	if err == nil {
+		t.Fatal("expected handshake to time out")
+	}
+	if !retry {
+		t.Errorf("expected a timeout to be retryable, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("handshake took %s, timeout was %s", elapsed, config.Timeout)
+	}
+}
+
+func TestDialInterrupted(t *testing.T) {
+	// A server that accepts connections but never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	config := &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         time.Minute,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, retry, err := dial(ctx, nil, ln.Addr().String(), config)
+	if !errors.Is(err, errInterrupted) || retry {
+		t.Errorf("expected interrupted handshake without retry, got %v, retry=%v", err, retry)
+	}
+}
+
+// testHost returns a host for srv that trusts its host key and ignores the
+// local SSH setup.
+func testHost(t *testing.T, srv *sshtest.Server) Host {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SSH_AUTH_SOCK", "")
+	return Host{
+		Address:           srv.Host(),
+		Port:              srv.Port(),
+		User:              "deploy",
+		HostKey:           srv.HostKeyLine(),
+		IdentitiesOnly:    true,
+		KeepaliveInterval: -1,
+	}
+}
+
+// needShell skips the test if sh, which runs *_cmd settings, is missing.
+func needShell(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not in PATH")
+	}
+}
+
+func connect(t *testing.T, host Host) *SSHClient {
+	t.Helper()
+	client, err := newSSHClient(context.Background(), host, nil)
+	if err != nil {
+		t.Fatalf("newSSHClient failed: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// newTestKey generates an ed25519 key and its signer.
+func newTestKey(t *testing.T) (ed25519.PrivateKey, ssh.Signer) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+	return priv, signer
+}
+
+// writeTestKey writes a new private key, encrypted with passphrase if set,
+// and returns its path and public key.
+func writeTestKey(t *testing.T, passphrase string) (string, ssh.PublicKey) {
+	t.Helper()
+	priv, signer := newTestKey(t)
+	var block *pem.Block
+	var err error
+	if passphrase != "" {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte(passphrase))
+	} else {
+		block, err = ssh.MarshalPrivateKey(priv, "")
+	}
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return keyPath, signer.PublicKey()
+}
+
+func TestClientAuth(t *testing.T) {
+	keyPath, pub := writeTestKey(t, "")
+
+	tests := []struct {
+		name  string
+		cfg   sshtest.Config
+		setup func(h *Host)
+		want  string
+	}{
+		{"password", sshtest.Config{Password: "secret"}, func(h *Host) { h.Password = "secret" }, authPassword},
+		{"publickey", sshtest.Config{AuthorizedKeys: []ssh.PublicKey{pub}}, func(h *Host) { h.KeyFile = keyPath }, authPublicKey},
+		{"keyboard-interactive", sshtest.Config{Password: "secret", KeyboardInteractive: true}, func(h *Host) {
+			h.Password = "secret"
+			h.AuthMethods = []string{authKeyboardInteractive}
+		}, authKeyboardInteractive},
+		{"auth_methods order", sshtest.Config{Password: "secret", AuthorizedKeys: []ssh.PublicKey{pub}}, func(h *Host) {
+			h.KeyFile = keyPath
+			h.Password = "secret"
+			h.AuthMethods = []string{authPassword, authPublicKey}
+		}, authPassword},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := sshtest.NewServer(t, tt.cfg)
+			host := testHost(t, srv)
+			tt.setup(&host)
+			connect(t, host)
+			if auths := srv.Auths(); len(auths) != 1 || auths[0] != tt.want {
+				t.Errorf("expected %s auth, got %v", tt.want, auths)
+			}
+		})
+	}
+
+	t.Run("wrong password", func(t *testing.T) {
+		srv := sshtest.NewServer(t, sshtest.Config{Password: "secret"})
+		host := testHost(t, srv)
+		host.Password = "wrong"
+		host.AuthMethods = []string{authPassword}
+		if _, err := newSSHClient(context.Background(), host, nil); err == nil {
+			t.Fatal("expected authentication to fail")
+		}
+	})
+}
+
+func TestClientHostKey(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Config{Password: "secret"})
+	host := testHost(t, srv)
+	host.Password = "secret"
+
+	// A pinned key that doesn't match
+	host.HostKey = string(ssh.MarshalAuthorizedKey(newTestHostKey(t)))
+	_, err := newSSHClient(context.Background(), host, nil)
+	if err == nil || !strings.Contains(err.Error(), "does not match host_key") {
+		t.Errorf("expected host key mismatch, got %v", err)
+	}
+
+	// known_hosts, strict: unknown hosts are rejected, known ones trusted
+	host.HostKey = ""
+	host.KnownHostsFile = filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(host.KnownHostsFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newSSHClient(context.Background(), host, nil); err == nil {
+		t.Error("expected unknown host to be rejected")
+	}
+
+	addr := knownhosts.Normalize(net.JoinHostPort(srv.Host(), strconv.Itoa(srv.Port())))
+	line := knownhosts.Line([]string{addr}, srv.HostKey)
+	if err := os.WriteFile(host.KnownHostsFile, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	connect(t, host)
+}
+
+func TestRunEnv(t *testing.T) {
+	for _, reject := range []bool{false, true} {
+		srv := sshtest.NewServer(t, sshtest.Config{Password: "secret", RejectEnv: reject})
+		host := testHost(t, srv)
+		host.Password = "secret"
+		host.Env = map[string]string{"GREETING": "hello world"}
+		client := connect(t, host)
+
+		var stdout bytes.Buffer
+		opts := RunOptions{Stdout: &stdout, Env: map[string]string{"NAME": "it's me"}}
+		if err := client.Run(context.Background(), `echo "$GREETING, $NAME"`, opts); err != nil {
+			t.Fatalf("reject=%v: Run failed: %v", reject, err)
+		}
+		if got := stdout.String(); got != "hello world, it's me\n" {
+			t.Errorf("reject=%v: expected env in output, got %q", reject, got)
+		}
+
+		e := srv.Execs()[0]
+		if reject {
+			// Exported inline instead
+			if !strings.HasPrefix(e.Command, "export GREETING='hello world' NAME='it'\\''s me'; ") {
+				t.Errorf("expected inline exports, got %q", e.Command)
+			}
+			if !client.setenvRejected.Load() {
+				t.Error("expected rejection to be remembered")
+			}
+		} else if e.Env["GREETING"] != "hello world" || e.Env["NAME"] != "it's me" {
+			t.Errorf("expected env requests, got %v", e.Env)
+		}
+	}
+}
+
+func TestRunStdinAndExitStatus(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Config{Password: "secret"})
+	host := testHost(t, srv)
+	host.Password = "secret"
+	client := connect(t, host)
+
+	var stdout bytes.Buffer
+	opts := RunOptions{Stdin: strings.NewReader("SELECT 1;\n"), Stdout: &stdout}
+	if err := client.Run(context.Background(), "cat", opts); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stdout.String() != "SELECT 1;\n" {
+		t.Errorf("expected stdin to be echoed, got %q", stdout.String())
+	}
+
+	err := client.Run(context.Background(), "exit 3", RunOptions{})
+	if code := exitCode(err); code != 3 {
+		t.Errorf("expected exit code 3, got %d (%v)", code, err)
+	}
+}
+
+func TestRunInterrupt(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Config{Password: "secret"})
+	host := testHost(t, srv)
+	host.Password = "secret"
+	client := connect(t, host)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := client.Run(ctx, "sleep 10", RunOptions{})
+	if !errors.Is(err, errInterrupted) {
+		t.Fatalf("expected interrupted error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > interruptGrace {
+		t.Errorf("interrupt took %s", elapsed)
+	}
+	if signals := srv.Execs()[0].Signals; len(signals) != 1 || signals[0] != "INT" {
+		t.Errorf("expected SIGINT to be sent, got %v", signals)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kevinburke/ssh_config"
+)
+
+// Origins of host values that were not set in sctl.toml.
+const (
+	originSSHConfig = "~/.ssh/config"
+	originDefaults  = "[defaults]"
+	originDefault   = "default"
+)
+
+// sshHostConfig holds the settings the OpenSSH client config defines for
+// an alias. Empty fields are not set there.
+type sshHostConfig struct {
+	HostName        string
+	User            string
+	Port            int
+	IdentityFile    string
+	CertificateFile string
+	ProxyJump       string
+	IdentitiesOnly  bool
+}
+
+// loadSSHConfig parses an OpenSSH client config. A missing file is not an
+// error and yields a nil config.
+func loadSSHConfig(path string) (*ssh_config.Config, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ssh_config.Decode(f)
+}
+
+// lookupSSHConfig returns the settings for alias. The first matching
+// value wins, as in OpenSSH.
+func lookupSSHConfig(sc *ssh_config.Config, alias string) sshHostConfig {
+	var hc sshHostConfig
+	if sc == nil {
+		return hc
+	}
+
+	get := func(key string) string {
+		v, _ := sc.Get(alias, key)
+		return strings.TrimSpace(v)
+	}
+
+	hc.HostName = strings.ReplaceAll(get("HostName"), "%h", alias)
+	hc.User = get("User")
+	if port, err := strconv.Atoi(get("Port")); err == nil {
+		hc.Port = port
+	}
+	hc.IdentityFile = get("IdentityFile")
+	hc.CertificateFile = get("CertificateFile")
+	if jump := get("ProxyJump"); !strings.EqualFold(jump, "none") {
+		hc.ProxyJump = jump
+	}
+	hc.IdentitiesOnly = strings.EqualFold(get("IdentitiesOnly"), "yes")
+	return hc
+}
+
+// resolveHost fills unset host values from the [defaults] section, then
+// from the OpenSSH client config and finally from built-in defaults,
+// recording where each value came from. Everything in sctl.toml, defaults
+// included, beats a wildcard Host * in the ssh config. The host's address (or its name,
+// if no address is set) is the alias looked up in the ssh config.
+func resolveHost(sc *ssh_config.Config, name string, host, defaults Host) Host {
+	alias := host.Address
+	if alias == "" {
+		alias = name
+	}
+	hc := lookupSSHConfig(sc, alias)
+
+	origins := make(map[string]string)
+	for _, key := range host.inherit(defaults) {
+		origins[key] = originDefaults
+	}
+
+	// The address is an alias, as for ssh <address>, so its HostName wins
+	if hc.HostName != "" && hc.HostName != host.Address {
+		host.Address = hc.HostName
+		origins["address"] = originSSHConfig
+	}
+	if host.User == "" && hc.User != "" {
+		host.User = hc.User
+		origins["user"] = originSSHConfig
+	}
+	if host.Port == 0 && hc.Port != 0 {
+		host.Port = hc.Port
+		origins["port"] = originSSHConfig
+	}
+	if host.KeyFile == "" && hc.IdentityFile != "" {
+		host.KeyFile = expandTokens(hc.IdentityFile, host)
+		origins["key_file"] = originSSHConfig
+	}
+	if host.CertFile == "" && hc.CertificateFile != "" {
+		host.CertFile = expandTokens(hc.CertificateFile, host)
+		origins["cert_file"] = originSSHConfig
+	}
+	if host.Jump == "" && hc.ProxyJump != "" {
+		host.Jump = hc.ProxyJump
+		origins["jump"] = originSSHConfig
+	}
+	if !host.IdentitiesOnly && hc.IdentitiesOnly {
+		host.IdentitiesOnly = true
+		origins["identities_only"] = originSSHConfig
+	}
+
+	if host.User == "" {
+		host.User = os.Getenv("USER")
+		origins["user"] = originDefault
+	}
+	if host.Port == 0 {
+		host.Port = 22
+		origins["port"] = originDefault
+	}
+
+	host.KeyFile = expandHome(host.KeyFile)
+	host.CertFile = expandHome(host.CertFile)
+	host.KnownHostsFile = expandHome(host.KnownHostsFile)
+	host.Origins = origins
+	return host
+}
+
+// expandTokens expands the OpenSSH path tokens %d (home), %h (host),
+// %r (remote user), %u (local user) and %%.
+func expandTokens(s string, host Host) string {
+	home, _ := os.UserHomeDir()
+	r := strings.NewReplacer(
+		"%%", "%",
+		"%d", home,
+		"%h", host.Address,
+		"%r", host.User,
+		"%u", os.Getenv("USER"),
+	)
+	return r.Replace(s)
+}
+
+// expandHome replaces a leading ~ with the user's home directory.
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Step is a single task step. In the config a step is either a shell
+// command string or a table for the other kinds:
+//
+//	{ run = "systemctl restart app" }
+//	{ run = "psql mydb", input = "VACUUM ANALYZE;" }
+//	{ upload = "dist/app.tar.gz", to = "/tmp/app.tar.gz", mode = "0644" }
+//	{ template = "app.env.tmpl", to = "/etc/app.env" }
+//	{ sync = "public", to = "/var/www/site", delete = true, exclude = ["*.map"] }
+//	{ tar = "dist", to = "/var/www/app" }
+//
+// Local paths are relative to the current directory, relative remote
+// paths to the task's workdir.
+type Step struct {
+	Run      string
+	Upload   string
+	Template string
+	Sync     string
+	Tar      string
+	To       string
+	Mode     string
+
+	// Input is fed to a run step's command on stdin
+	Input string
+
+	// Privilege escalation for run steps, overriding the task's
+	Become       *bool
+	BecomeUser   string
+	BecomeMethod string
+
+	// Sync options, see syncOptions; exclude also applies to tar
+	Delete   bool
+	Exclude  []string
+	Checksum bool
+}
+
+// UnmarshalTOML accepts a plain string as a shell command or a table with
+// the step's fields.
+func (s *Step) UnmarshalTOML(v any) error {
+	switch v := v.(type) {
+	case string:
+		*s = Step{Run: v}
+		return nil
+	case map[string]any:
+		*s = Step{}
+		for key, value := range v {
+			var err error
+			switch key {
+			case "run":
+				err = stepField(key, value, &s.Run)
+			case "upload":
+				err = stepField(key, value, &s.Upload)
+			case "template":
+				err = stepField(key, value, &s.Template)
+			case "sync":
+				err = stepField(key, value, &s.Sync)
+			case "tar":
+				err = stepField(key, value, &s.Tar)
+			case "to":
+				err = stepField(key, value, &s.To)
+			case "mode":
+				err = stepField(key, value, &s.Mode)
+			case "input":
+				err = stepField(key, value, &s.Input)
+			case "become":
+				var become bool
+				err = stepField(key, value, &become)
+				s.Become = &become
+			case "become_user":
+				err = stepField(key, value, &s.BecomeUser)
+			case "become_method":
+				err = stepField(key, value, &s.BecomeMethod)
+			case "delete":
+				err = stepField(key, value, &s.Delete)
+			case "checksum":
+				err = stepField(key, value, &s.Checksum)
+			case "exclude":
+				list, ok := value.([]any)
+				if !ok {
+					return fmt.Errorf("step field %q must be a list of strings", key)
+				}
+				for _, item := range list {
+					var pattern string
+					if err := stepField(key, item, &pattern); err != nil {
+						return err
+					}
+					s.Exclude = append(s.Exclude, pattern)
+				}
+			default:
+				return fmt.Errorf("unknown step field %q", key)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("step must be a string or a table, got %T", v)
+	}
+}
+
+// stepField stores a table value in dst if it has the right type.
+func stepField[T any](key string, value any, dst *T) error {
+	v, ok := value.(T)
+	if !ok {
+		return fmt.Errorf("step field %q must be a %T", key, *dst)
+	}
+	*dst = v
+	return nil
+}
+
+// Validate checks that the step is exactly one kind and has what that
+// kind needs.
+func (s Step) Validate() error {
+	kinds := 0
+	for _, set := range []bool{s.Run != "", s.Upload != "", s.Template != "", s.Sync != "", s.Tar != ""} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return fmt.Errorf("step needs exactly one of 'run', 'upload', 'template', 'sync' or 'tar'")
+	}
+	if s.Sync == "" && (s.Delete || s.Checksum) {
+		return fmt.Errorf("'delete' and 'checksum' are only for sync steps")
+	}
+	if s.Sync == "" && s.Tar == "" && len(s.Exclude) > 0 {
+		return fmt.Errorf("'exclude' is only for sync and tar steps")
+	}
+	if s.Run == "" && s.Input != "" {
+		return fmt.Errorf("'input' is only for run steps")
+	}
+	if s.Run == "" && (s.Become != nil || s.BecomeUser != "" || s.BecomeMethod != "") {
+		return fmt.Errorf("'become' options are only for run steps")
+	}
+	if err := validBecomeMethod(s.BecomeMethod); err != nil {
+		return err
+	}
+	if s.Run != "" {
+		if s.To != "" || s.Mode != "" {
+			return fmt.Errorf("'to' and 'mode' are only for file steps")
+		}
+		return nil
+	}
+	if s.To == "" {
+		return fmt.Errorf("%s step needs 'to'", s.kind())
+	}
+	if (s.Sync != "" || s.Tar != "") && s.Mode != "" {
+		return fmt.Errorf("'mode' is not supported for %s steps, local modes are kept", s.kind())
+	}
+	if _, err := s.fileMode(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s Step) kind() string {
+	switch {
+	case s.Upload != "":
+		return "upload"
+	case s.Template != "":
+		return "template"
+	case s.Sync != "":
+		return "sync"
+	case s.Tar != "":
+		return "tar"
+	}
+	return "run"
+}
+
+// String describes the step for progress output.
+func (s Step) String() string {
+	switch s.kind() {
+	case "upload":
+		return fmt.Sprintf("upload %s -> %s", s.Upload, s.To)
+	case "template":
+		return fmt.Sprintf("template %s -> %s", s.Template, s.To)
+	case "sync":
+		return fmt.Sprintf("sync %s -> %s", s.Sync, s.To)
+	case "tar":
+		return fmt.Sprintf("tar %s -> %s", s.Tar, s.To)
+	}
+	return s.Run
+}
+
+// fileMode parses the octal mode, 0 if none is set.
+func (s Step) fileMode() (os.FileMode, error) {
+	if s.Mode == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(s.Mode, 8, 32)
+	if err != nil || mode > 0o7777 {
+		return 0, fmt.Errorf("invalid mode %q (use octal, e.g. \"0644\")", s.Mode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// templateData is what templates can refer to: the host's settings under
+// .Host, its config name as .HostName and the merged host and task vars
+// under .Vars.
+type templateData struct {
+	HostName string
+	Host     Host
+	Vars     map[string]any
+}
+
+// runStep runs one step of task on client.
+func runStep(ctx context.Context, client *SSHClient, hostName string, task Task, step Step, opts RunOptions) error {
+	if step.Run != "" {
+		cmd := step.Run
+		if task.Workdir != "" {
+			cmd = fmt.Sprintf("cd %s && %s", task.Workdir, step.Run)
+		}
+		if step.Input != "" {
+			opts.Stdin = strings.NewReader(step.Input)
+		}
+		if b := task.becomeFor(step); b != nil {
+			if b.Method == becomeSudo && !opts.TTY {
+				var err error
+				if b.Password, err = client.becomePassword(task.becomePassword); err != nil {
+					return err
+				}
+			}
+			opts.Become = b
+		}
+		return client.Run(ctx, cmd, opts)
+	}
+
+	to := step.To
+	if task.Workdir != "" && !path.IsAbs(to) {
+		to = path.Join(task.Workdir, to)
+	}
+	mode, err := step.fileMode()
+	if err != nil {
+		return err
+	}
+
+	if step.Upload != "" {
+		return client.Upload(ctx, step.Upload, to, copyOptions{Mode: mode})
+	}
+	if step.Sync != "" {
+		stats, err := client.Sync(ctx, step.Sync, to, syncOptions{
+			Delete:   step.Delete,
+			Exclude:  step.Exclude,
+			Checksum: step.Checksum,
+			Log:      opts.Stdout,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(opts.Stdout, "  %s\n", stats)
+		return nil
+	}
+	if step.Tar != "" {
+		stats, err := client.ExtractTar(ctx, step.Tar, to, step.Exclude, opts.Stdout, opts.Stderr)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(opts.Stdout, "  %s\n", stats)
+		return nil
+	}
+
+	data := templateData{
+		HostName: hostName,
+		Host:     client.host,
+		Vars:     mergeMaps(client.host.Vars, task.Vars),
+	}
+	content, err := renderTemplate(step.Template, data)
+	if err != nil {
+		return err
+	}
+	return client.WriteFile(to, content, mode)
+}
+
+// renderTemplate renders the text/template file at path. Missing keys are
+// an error so a typo doesn't silently render as "<no value>".
+func renderTemplate(file string, data templateData) ([]byte, error) {
+	text, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(path.Base(file)).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStepsFromConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.toml")
+
+	configContent := `
+[hosts.web1]
+address = "web1.example.com"
+vars = { env = "production", port = 8080 }
+
+[tasks.deploy]
+host = "web1"
+vars = { env = "staging" }
+steps = [
+    "systemctl stop app",
+    { upload = "dist/app.tar.gz", to = "/tmp/app.tar.gz", mode = "0644" },
+    { template = "app.env.tmpl", to = "/etc/app.env" },
+    { sync = "public", to = "/var/www/site", delete = true, exclude = ["*.map", "uploads"] },
+    { run = "psql app", input = """
+VACUUM ANALYZE;
+""" },
+    { run = "systemctl start app" },
+]
+`
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatalf("failed to write test config: %v", err)
+	}
+
+	cfg, err := loadConfig(configPath, "")
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+
+	task := cfg.Tasks["deploy"]
+	if err := task.Validate("deploy"); err != nil {
+		t.Fatalf("expected valid task, got %v", err)
+	}
+	want := []Step{
+		{Run: "systemctl stop app"},
+		{Upload: "dist/app.tar.gz", To: "/tmp/app.tar.gz", Mode: "0644"},
+		{Template: "app.env.tmpl", To: "/etc/app.env"},
+		{Sync: "public", To: "/var/www/site", Delete: true, Exclude: []string{"*.map", "uploads"}},
+		{Run: "psql app", Input: "VACUUM ANALYZE;\n"},
+		{Run: "systemctl start app"},
+	}
+	if len(task.Steps) != len(want) {
+		t.Fatalf("expected %d steps, got %d", len(want), len(task.Steps))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(task.Steps[i], want[i]) {
+			t.Errorf("step %d: expected %+v, got %+v", i+1, want[i], task.Steps[i])
+		}
+	}
+
+	vars := mergeMaps(cfg.Hosts["web1"].Vars, task.Vars)
+	if vars["env"] != "staging" || vars["port"] != int64(8080) {
+		t.Errorf("expected task vars to override host vars, got %v", vars)
+	}
+}
+
+func TestStepValidate(t *testing.T) {
+	invalid := []Step{
+		{},
+		{Run: "ls", Upload: "a"},
+		{Upload: "a"},
+		{Template: "a.tmpl", To: "/etc/a", Mode: "rw-r--r--"},
+		{Run: "ls", To: "/tmp"},
+		{Upload: "a", To: "/tmp/a", Delete: true},
+		{Upload: "a", To: "/tmp/a", Input: "data"},
+	}
+	for _, step := range invalid {
+		if err := step.Validate(); err == nil {
+			t.Errorf("expected error for %+v", step)
+		}
+	}
+	if err := (Step{Upload: "a", To: "/tmp/a", Mode: "0755"}).Validate(); err != nil {
+		t.Errorf("expected valid upload step, got %v", err)
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	tmpl := filepath.Join(t.TempDir(), "app.env.tmpl")
+	os.WriteFile(tmpl, []byte("ENV={{ .Vars.env }}\nHOST={{ .HostName }} ({{ .Host.Address }})\n"), 0644)
+
+	data := templateData{
+		HostName: "web1",
+		Host:     Host{Address: "web1.example.com"},
+		Vars:     map[string]any{"env": "production"},
+	}
+	out, err := renderTemplate(tmpl, data)
+	if err != nil {
+		t.Fatalf("renderTemplate failed: %v", err)
+	}
+	if want := "ENV=production\nHOST=web1 (web1.example.com)\n"; string(out) != want {
+		t.Errorf("expected %q, got %q", want, out)
+	}
+
+	// Unknown variables are an error, not "<no value>"
+	os.WriteFile(tmpl, []byte("{{ .Vars.missing }}"), 0644)
+	if _, err := renderTemplate(tmpl, data); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("expected missing key error, got %v", err)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// syncOptions controls how a directory is synced.
+type syncOptions struct {
+	Delete   bool      // remove remote files that don't exist locally
+	Exclude  []string  // patterns of paths to leave alone on both sides
+	Checksum bool      // compare content hashes instead of size and mtime
+	Log      io.Writer // where to list changed files, nil for none
+}
+
+// syncStats counts what a sync did.
+type syncStats struct {
+	Uploaded  int
+	Unchanged int
+	Deleted   int
+	Bytes     int64
+}
+
+func (s syncStats) String() string {
+	return fmt.Sprintf("%d uploaded (%s), %d unchanged, %d deleted",
+		s.Uploaded, formatBytes(s.Bytes), s.Unchanged, s.Deleted)
+}
+
+// remoteSumsFunc returns the SHA-256 hex digests of files, given as paths
+// relative to dir on the host.
+type remoteSumsFunc func(dir string, files []string) (map[string]string, error)
+
+// Sync makes the remote directory dst match the local directory src,
+// uploading only files that are new or changed. Uploaded files get the
+// local mode and mtime, so an unchanged file compares equal next time.
+func (c *SSHClient) Sync(ctx context.Context, src, dst string, opts syncOptions) (syncStats, error) {
+	sc, err := c.SFTP()
+	if err != nil {
+		return syncStats{}, err
+	}
+	remoteSums := func(dir string, files []string) (map[string]string, error) {
+		return c.sha256sums(ctx, dir, files)
+	}
+	return syncDir(ctx, sc, remoteSums, src, path.Clean(remotePath(dst)), opts)
+}
+
+// sha256sumsBatch limits how many files are hashed per remote command, to
+// stay below the command line length limit.
+const sha256sumsBatch = 200
+
+// sha256sums hashes files on the host with sha256sum, so checksums don't
+// need the files to be downloaded.
+func (c *SSHClient) sha256sums(ctx context.Context, dir string, files []string) (map[string]string, error) {
+	sums := make(map[string]string)
+	for batch := range slices.Chunk(files, sha256sumsBatch) {
+		quoted := make([]string, len(batch))
+		for i, f := range batch {
+			quoted[i] = shellQuote(f)
+		}
+		var stdout, stderr bytes.Buffer
+		cmd := fmt.Sprintf("cd %s && sha256sum -- %s", shellQuote(dir), strings.Join(quoted, " "))
+		if err := c.Run(ctx, cmd, RunOptions{Stdout: &stdout, Stderr: &stderr}); err != nil {
+			return nil, fmt.Errorf("sha256sum on remote: %w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+
+		scanner := bufio.NewScanner(&stdout)
+		for scanner.Scan() {
+			// "<hash>  <file>"; escaped names start with a backslash and
+			// are left out, so they count as changed
+			sum, file, ok := strings.Cut(scanner.Text(), "  ")
+			if ok && !strings.HasPrefix(sum, `\`) {
+				sums[file] = sum
+			}
+		}
+	}
+	return sums, nil
+}
+
+func syncDir(ctx context.Context, sc *sftp.Client, remoteSums remoteSumsFunc, src, dst string, opts syncOptions) (syncStats, error) {
+	var stats syncStats
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return stats, err
+	}
+	if !info.IsDir() {
+		return stats, fmt.Errorf("%s is not a directory", src)
+	}
+
+	local, err := localTree(src, opts.Exclude)
+	if err != nil {
+		return stats, err
+	}
+	remote, err := remoteTree(sc, dst, opts.Exclude)
+	if err != nil {
+		return stats, err
+	}
+
+	// Decide what to upload; same-size files are hashed in one go if
+	// checksums are requested
+	var changed, candidates []string
+	for _, rel := range slices.Sorted(maps.Keys(local)) {
+		l := local[rel]
+		if l.IsDir() {
+			continue
+		}
+		r, ok := remote[rel]
+		switch {
+		case !ok || r.IsDir() || r.Size() != l.Size():
+			changed = append(changed, rel)
+		case opts.Checksum:
+			candidates = append(candidates, rel)
+		case r.ModTime().Unix() != l.ModTime().Unix():
+			changed = append(changed, rel)
+		default:
+			stats.Unchanged++
+		}
+	}
+	if len(candidates) > 0 {
+		sums, err := remoteSums(dst, candidates)
+		if err != nil {
+			return stats, err
+		}
+		for _, rel := range candidates {
+			sum, err := fileSHA256(filepath.Join(src, filepath.FromSlash(rel)))
+			if err != nil {
+				return stats, err
+			}
+			if sums[rel] == sum {
+				stats.Unchanged++
+			} else {
+				changed = append(changed, rel)
+			}
+		}
+		slices.Sort(changed)
+	}
+
+	// Directories first, so files have somewhere to go
+	if err := sc.MkdirAll(dst); err != nil {
+		return stats, fmt.Errorf("creating %s: %w", dst, err)
+	}
+	for _, rel := range slices.Sorted(maps.Keys(local)) {
+		if l := local[rel]; l.IsDir() {
+			if r, ok := remote[rel]; ok {
+				if r.IsDir() {
+					continue
+				}
+				// A file where the directory should be
+				if err := sc.Remove(path.Join(dst, rel)); err != nil {
+					return stats, err
+				}
+			}
+			if err := sc.MkdirAll(path.Join(dst, rel)); err != nil {
+				return stats, fmt.Errorf("creating %s: %w", path.Join(dst, rel), err)
+			}
+		}
+	}
+
+	for _, rel := range changed {
+		l := local[rel]
+		if r, ok := remote[rel]; ok && r.IsDir() {
+			if err := sc.RemoveAll(path.Join(dst, rel)); err != nil {
+				return stats, err
+			}
+		}
+		logf(opts.Log, "  + %s\n", rel)
+		err := uploadFile(ctx, sc, filepath.Join(src, filepath.FromSlash(rel)), path.Join(dst, rel), l, copyOptions{Preserve: true})
+		if err != nil {
+			return stats, err
+		}
+		stats.Uploaded++
+		stats.Bytes += l.Size()
+	}
+
+	if opts.Delete {
+		// Deepest paths first so directories are empty when removed
+		var stale []string
+		for rel := range remote {
+			if _, ok := local[rel]; !ok {
+				stale = append(stale, rel)
+			}
+		}
+		slices.SortFunc(stale, func(a, b string) int { return strings.Compare(b, a) })
+		for _, rel := range stale {
+			logf(opts.Log, "  - %s\n", rel)
+			if err := sc.RemoveAll(path.Join(dst, rel)); err != nil {
+				return stats, err
+			}
+			stats.Deleted++
+		}
+	}
+
+	return stats, nil
+}
+
+// localTree lists the directories and regular files below root by
+// slash-separated relative path.
+func localTree(root string, exclude []string) (map[string]fs.FileInfo, error) {
+	tree := make(map[string]fs.FileInfo)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if excluded(rel, exclude) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			printWarning("Skipping %s: not a regular file", p)
+			return nil
+		}
+		tree[rel] = info
+		return nil
+	})
+	return tree, err
+}
+
+// remoteTree lists the entries below root on the host. A missing root
+// is an empty tree. Directories holding excluded entries are left out, so
+// --delete never removes them.
+func remoteTree(sc *sftp.Client, root string, exclude []string) (map[string]fs.FileInfo, error) {
+	tree := make(map[string]fs.FileInfo)
+	if _, err := sc.Stat(root); err != nil {
+		if os.IsNotExist(err) {
+			return tree, nil
+		}
+		return nil, err
+	}
+
+	var kept []string
+	walker := sc.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, err
+		}
+		if walker.Path() == root {
+			continue
+		}
+		rel := strings.TrimPrefix(walker.Path(), strings.TrimSuffix(root, "/")+"/")
+		if excluded(rel, exclude) {
+			kept = append(kept, rel)
+			if walker.Stat().IsDir() {
+				walker.SkipDir()
+			}
+			continue
+		}
+		tree[rel] = walker.Stat()
+	}
+
+	for _, rel := range kept {
+		for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+			delete(tree, dir)
+		}
+	}
+	return tree, nil
+}
+
+// excluded reports whether rel matches one of the patterns. Patterns
+// without a slash match any path element, like *.map or node_modules;
+// patterns with a slash match the path from the sync root.
+func excluded(rel string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.Trim(pattern, "/")
+		if strings.Contains(pattern, "/") {
+			if ok, _ := path.Match(pattern, rel); ok {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func fileSHA256(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func logf(w io.Writer, format string, a ...any) {
+	if w != nil {
+		fmt.Fprintf(w, format, a...)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// localSums stands in for sha256sum on the host in tests, where the
+// "remote" side is a local directory.
+func localSums(dir string, files []string) (map[string]string, error) {
+	sums := make(map[string]string)
+	for _, f := range files {
+		sum, err := fileSHA256(filepath.Join(dir, f))
+		if err != nil {
+			return nil, err
+		}
+		sums[f] = sum
+	}
+	return sums, nil
+}
+
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSyncDir(t *testing.T) {
+	sc := newTestSFTP(t)
+	src, dst := t.TempDir(), filepath.Join(t.TempDir(), "site")
+
+	writeTree(t, src, map[string]string{
+		"index.html":     "home",
+		"css/app.css":    "body{}",
+		"js/app.js.map":  "map",
+		"uploads/keep.x": "local upload",
+	})
+
+	opts := syncOptions{Delete: true, Exclude: []string{"*.map", "uploads"}}
+	stats, err := syncDir(context.Background(), sc, localSums, src, dst, opts)
+	if err != nil {
+		t.Fatalf("first sync failed: %v", err)
+	}
+	if stats.Uploaded != 2 || stats.Unchanged != 0 {
+		t.Errorf("first sync: expected 2 uploads, got %s", stats)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "js", "app.js.map")); !os.IsNotExist(err) {
+		t.Errorf("expected excluded file not to be uploaded")
+	}
+
+	// Nothing changed: nothing to upload
+	stats, err = syncDir(context.Background(), sc, localSums, src, dst, opts)
+	if err != nil {
+		t.Fatalf("second sync failed: %v", err)
+	}
+	if stats.Uploaded != 0 || stats.Unchanged != 2 {
+		t.Errorf("second sync: expected no uploads, got %s", stats)
+	}
+
+	// Remote-only files are deleted, except excluded ones
+	writeTree(t, dst, map[string]string{"old.html": "stale", "uploads/user.png": "data"})
+	os.Remove(filepath.Join(src, "css", "app.css"))
+	stats, err = syncDir(context.Background(), sc, localSums, src, dst, opts)
+	if err != nil {
+		t.Fatalf("third sync failed: %v", err)
+	}
+	for _, gone := range []string{"old.html", "css/app.css"} {
+		if _, err := os.Stat(filepath.Join(dst, gone)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be deleted", gone)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "uploads", "user.png")); err != nil {
+		t.Errorf("expected excluded remote file to be kept: %v", err)
+	}
+}
+
+func TestSyncDirChecksum(t *testing.T) {
+	sc := newTestSFTP(t)
+	src, dst := t.TempDir(), t.TempDir()
+
+	writeTree(t, src, map[string]string{"a.txt": "same", "b.txt": "new!"})
+	writeTree(t, dst, map[string]string{"a.txt": "same", "b.txt": "old!"})
+
+	// Same size, different mtimes: only content decides
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dst, "a.txt"), old, old)
+	os.Chtimes(filepath.Join(dst, "b.txt"), old, old)
+
+	stats, err := syncDir(context.Background(), sc, localSums, src, dst, syncOptions{Checksum: true})
+	if err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if stats.Uploaded != 1 || stats.Unchanged != 1 {
+		t.Errorf("expected 1 upload and 1 unchanged, got %s", stats)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dst, "b.txt")); string(data) != "new!" {
+		t.Errorf("expected b.txt to be updated, got %q", data)
+	}
+}
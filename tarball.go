@@ -0,0 +1,153 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// tarStats describes a streamed tarball upload.
+type tarStats struct {
+	Files    int
+	Bytes    int64 // compressed bytes sent
+	Duration time.Duration
+}
+
+func (s tarStats) String() string {
+	return fmt.Sprintf("sent %d files, %s in %s", s.Files, formatBytes(s.Bytes), s.Duration.Round(time.Millisecond))
+}
+
+// ExtractTar streams the local directory src as a gzipped tarball into
+// tar on the host, unpacking it into dst. Nothing is written to disk on
+// either side besides the extracted files.
+func (c *SSHClient) ExtractTar(ctx context.Context, src, dst string, exclude []string, stdout, stderr io.Writer) (tarStats, error) {
+	start := time.Now()
+	info, err := os.Stat(src)
+	if err != nil {
+		return tarStats{}, err
+	}
+	if !info.IsDir() {
+		return tarStats{}, fmt.Errorf("%s is not a directory", src)
+	}
+
+	pr, pw := io.Pipe()
+	counter := &countingWriter{w: pw}
+	type result struct {
+		files int
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		files, err := writeTarGz(counter, src, exclude)
+		pw.CloseWithError(err)
+		done <- result{files, err}
+	}()
+
+	cmd := fmt.Sprintf("mkdir -p %[1]s && tar -xzf - -C %[1]s", shellQuote(dst))
+	runErr := c.Run(ctx, cmd, RunOptions{Stdin: pr, Stdout: stdout, Stderr: stderr})
+	// Unblock the writer if tar stopped reading early
+	pr.Close()
+	res := <-done
+
+	stats := tarStats{Files: res.files, Bytes: counter.n, Duration: time.Since(start)}
+	// Packing fails on the closed pipe once tar is gone
+	if errors.Is(runErr, errInterrupted) {
+		return stats, runErr
+	}
+	if res.err != nil {
+		return stats, fmt.Errorf("packing %s: %w", src, res.err)
+	}
+	return stats, runErr
+}
+
+// writeTarGz writes the contents of dir as a gzipped tarball to w, with
+// paths relative to dir, and returns the number of files written.
+func writeTarGz(w io.Writer, dir string, exclude []string) (int, error) {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	files := 0
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if excluded(rel, exclude) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		// Leave ownership to the remote tar, local ids mean nothing there
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.Copy(tw, f); err != nil {
+			return err
+		}
+		files++
+		return nil
+	})
+	if err != nil {
+		return files, err
+	}
+	if err := tw.Close(); err != nil {
+		return files, err
+	}
+	return files, gz.Close()
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"slices"
+	"testing"
+)
+
+func TestWriteTarGz(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"app":          "binary",
+		"static/a.css": "body{}",
+		"static/a.map": "map",
+	})
+
+	var buf bytes.Buffer
+	files, err := writeTarGz(&buf, dir, []string{"*.map"})
+	if err != nil {
+		t.Fatalf("writeTarGz failed: %v", err)
+	}
+	if files != 2 {
+		t.Errorf("expected 2 files, got %d", files)
+	}
+
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	var names []string
+	contents := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		data, _ := io.ReadAll(tr)
+		contents[hdr.Name] = string(data)
+	}
+
+	want := []string{"app", "static/", "static/a.css"}
+	if !slices.Equal(names, want) {
+		t.Errorf("expected entries %v, got %v", want, names)
+	}
+	if contents["static/a.css"] != "body{}" {
+		t.Errorf("unexpected content %q", contents["static/a.css"])
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// copyOptions controls how files are transferred.
+type copyOptions struct {
+	Recursive bool        // copy directories and their contents
+	Preserve  bool        // keep file modes and modification times
+	Mode      os.FileMode // mode for uploaded files, 0 to leave as is
+	Progress  io.Writer   // where to show progress, nil for none
+}
+
+// SFTP returns an SFTP client on the connection. It is opened on first use
+// and shared by later transfers on the same connection.
+func (c *SSHClient) SFTP() (*sftp.Client, error) {
+	c.sftpOnce.Do(func() {
+		c.sftp, c.sftpErr = sftp.NewClient(c.client)
+	})
+	return c.sftp, c.sftpErr
+}
+
+// splitRemote splits a host:path argument. Like scp, an argument is only
+// remote if the colon comes before any slash, so local paths containing a
+// colon can be given as ./name.
+func splitRemote(arg string) (host, p string, ok bool) {
+	i := strings.IndexByte(arg, ':')
+	if i <= 0 || strings.ContainsAny(arg[:i], `/\`) {
+		return "", "", false
+	}
+	return arg[:i], arg[i+1:], true
+}
+
+// remotePath turns a user-supplied remote path into an SFTP path. Relative
+// paths and ~/ are relative to the remote home directory.
+func remotePath(p string) string {
+	switch {
+	case p == "" || p == "~":
+		return "."
+	case strings.HasPrefix(p, "~/"):
+		return p[2:]
+	}
+	return p
+}
+
+// Upload copies the local file or directory src to dst on the host. If
+// dst is an existing directory, src is copied into it. Cancelling ctx
+// stops the copy.
+func (c *SSHClient) Upload(ctx context.Context, src, dst string, opts copyOptions) error {
+	sc, err := c.SFTP()
+	if err != nil {
+		return err
+	}
+	return upload(ctx, sc, src, remotePath(dst), opts)
+}
+
+func upload(ctx context.Context, sc *sftp.Client, src, dst string, opts copyOptions) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() && !opts.Recursive {
+		return fmt.Errorf("%s is a directory (use -r)", src)
+	}
+	if st, err := sc.Stat(dst); err == nil && st.IsDir() {
+		dst = path.Join(dst, filepath.Base(src))
+	}
+
+	if !info.IsDir() {
+		return uploadFile(ctx, sc, src, dst, info, opts)
+	}
+
+	return filepath.WalkDir(src, func(local string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return errInterrupted
+		}
+		rel, err := filepath.Rel(src, local)
+		if err != nil {
+			return err
+		}
+		remote := path.Join(dst, filepath.ToSlash(rel))
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			if err := sc.MkdirAll(remote); err != nil {
+				return fmt.Errorf("creating %s: %w", remote, err)
+			}
+			if opts.Preserve {
+				return sc.Chmod(remote, info.Mode().Perm())
+			}
+			return nil
+		case info.Mode().IsRegular():
+			return uploadFile(ctx, sc, local, remote, info, opts)
+		default:
+			printWarning("Skipping %s: not a regular file", local)
+			return nil
+		}
+	})
+}
+
+func uploadFile(ctx context.Context, sc *sftp.Client, src, dst string, info fs.FileInfo, opts copyOptions) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := sc.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", dst, err)
+	}
+	defer out.Close()
+
+	// Set the mode before writing, so a secret is never readable under
+	// the default umask while it is copied
+	mode := opts.Mode
+	if mode == 0 && opts.Preserve {
+		mode = info.Mode().Perm()
+	}
+	if mode != 0 {
+		if err := out.Chmod(mode); err != nil {
+			return fmt.Errorf("setting mode of %s: %w", dst, err)
+		}
+	}
+
+	p := newProgress(opts.Progress, src, info.Size())
+	if _, err := io.Copy(out, &progressReader{r: ctxReader{ctx, in}, p: p}); err != nil {
+		return fmt.Errorf("writing %s: %w", dst, err)
+	}
+	p.done()
+
+	if opts.Preserve {
+		return sc.Chtimes(dst, info.ModTime(), info.ModTime())
+	}
+	return nil
+}
+
+// WriteFile writes data to dst on the host, replacing any existing file.
+// A non-zero mode is set on the file before data is written.
+func (c *SSHClient) WriteFile(dst string, data []byte, mode os.FileMode) error {
+	sc, err := c.SFTP()
+	if err != nil {
+		return err
+	}
+	dst = remotePath(dst)
+
+	f, err := sc.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", dst, err)
+	}
+	if mode != 0 {
+		if err := f.Chmod(mode); err != nil {
+			f.Close()
+			return fmt.Errorf("setting mode of %s: %w", dst, err)
+		}
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("writing %s: %w", dst, err)
+	}
+	return f.Close()
+}
+
+// Download copies the file or directory src on the host to the local dst.
+// If dst is an existing directory, src is copied into it. Cancelling ctx
+// stops the copy.
+func (c *SSHClient) Download(ctx context.Context, src, dst string, opts copyOptions) error {
+	sc, err := c.SFTP()
+	if err != nil {
+		return err
+	}
+	return download(ctx, sc, path.Clean(remotePath(src)), dst, opts)
+}
+
+func download(ctx context.Context, sc *sftp.Client, src, dst string, opts copyOptions) error {
+	info, err := sc.Stat(src)
+	if err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	if info.IsDir() && !opts.Recursive {
+		return fmt.Errorf("%s is a directory (use -r)", src)
+	}
+	if st, err := os.Stat(dst); err == nil && st.IsDir() {
+		dst = filepath.Join(dst, path.Base(src))
+	}
+
+	if !info.IsDir() {
+		return downloadFile(ctx, sc, src, dst, info, opts)
+	}
+
+	walker := sc.Walk(src)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return errInterrupted
+		}
+		var rel string
+		if p := walker.Path(); p != src {
+			rel = strings.TrimPrefix(p, strings.TrimSuffix(src, "/")+"/")
+		}
+		local := filepath.Join(dst, filepath.FromSlash(rel))
+
+		info := walker.Stat()
+		switch {
+		case info.IsDir():
+			mode := os.FileMode(0755)
+			if opts.Preserve {
+				mode = info.Mode().Perm()
+			}
+			if err := os.MkdirAll(local, mode); err != nil {
+				return err
+			}
+			if opts.Preserve {
+				if err := os.Chmod(local, mode); err != nil {
+					return err
+				}
+			}
+		case info.Mode().IsRegular():
+			if err := downloadFile(ctx, sc, walker.Path(), local, info, opts); err != nil {
+				return err
+			}
+		default:
+			printWarning("Skipping %s: not a regular file", walker.Path())
+		}
+	}
+	return nil
+}
+
+func downloadFile(ctx context.Context, sc *sftp.Client, src, dst string, info fs.FileInfo, opts copyOptions) error {
+	in, err := sc.Open(src)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", src, err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	p := newProgress(opts.Progress, src, info.Size())
+	if _, err := io.Copy(&progressWriter{w: out, p: p}, ctxReader{ctx, in}); err != nil {
+		return fmt.Errorf("reading %s: %w", src, err)
+	}
+	p.done()
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if opts.Preserve {
+		if err := os.Chmod(dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+		return os.Chtimes(dst, info.ModTime(), info.ModTime())
+	}
+	return nil
+}
+
+// progress shows a single updating line for a file transfer.
+type progress struct {
+	out   io.Writer
+	name  string
+	total int64
+	n     int64
+	start time.Time
+	last  time.Time
+}
+
+func newProgress(out io.Writer, name string, total int64) *progress {
+	return &progress{out: out, name: name, total: total, start: time.Now()}
+}
+
+// progressInterval limits how often the progress line is redrawn.
+const progressInterval = 100 * time.Millisecond
+
+func (p *progress) add(n int) {
+	p.n += int64(n)
+	if p.out != nil && time.Since(p.last) >= progressInterval {
+		p.last = time.Now()
+		p.print()
+	}
+}
+
+func (p *progress) done() {
+	if p.out != nil {
+		p.print()
+		fmt.Fprintln(p.out)
+	}
+}
+
+func (p *progress) print() {
+	percent := 100
+	if p.total > 0 {
+		percent = int(p.n * 100 / p.total)
+	}
+	rate := float64(p.n) / max(time.Since(p.start).Seconds(), 0.001)
+	fmt.Fprintf(p.out, "\r  %s  %3d%%  %s/%s  %s/s\033[K",
+		p.name, percent, formatBytes(p.n), formatBytes(p.total), formatBytes(int64(rate)))
+}
+
+// ctxReader fails reads once ctx is cancelled, so an interrupted copy
+// stops after the chunk in flight.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(b []byte) (int, error) {
+	if r.ctx.Err() != nil {
+		return 0, errInterrupted
+	}
+	return r.r.Read(b)
+}
+
+type progressReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.p.add(n)
+	return n, err
+}
+
+type progressWriter struct {
+	w io.Writer
+	p *progress
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.p.add(n)
+	return n, err
+}
+
+// formatBytes formats a byte count with a binary unit, e.g. 1.5 MiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
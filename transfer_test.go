@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// newTestSFTP returns an SFTP client backed by an in-process server on
+// the local file system.
+func newTestSFTP(t *testing.T) *sftp.Client {
+	t.Helper()
+	clientR, serverW := io.Pipe()
+	serverR, clientW := io.Pipe()
+
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverR, serverW})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+
+	sc, err := sftp.NewClientPipe(clientR, clientW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// Closing the server ends the client's reader
+		server.Close()
+		sc.Close()
+	})
+	return sc
+}
+
+func TestSplitRemote(t *testing.T) {
+	tests := []struct {
+		arg    string
+		host   string
+		path   string
+		remote bool
+	}{
+		{"web1:/var/www", "web1", "/var/www", true},
+		{"web1:", "web1", "", true},
+		{"./web1:file", "", "", false},
+		{"/tmp/a:b", "", "", false},
+		{"local.txt", "", "", false},
+	}
+	for _, tt := range tests {
+		host, path, ok := splitRemote(tt.arg)
+		if host != tt.host || path != tt.path || ok != tt.remote {
+			t.Errorf("splitRemote(%q) = %q, %q, %v", tt.arg, host, path, ok)
+		}
+	}
+}
+
+func TestUploadDownloadRecursive(t *testing.T) {
+	sc := newTestSFTP(t)
+
+	src := filepath.Join(t.TempDir(), "site")
+	os.MkdirAll(filepath.Join(src, "assets"), 0755)
+	os.WriteFile(filepath.Join(src, "index.html"), []byte("<h1>hi</h1>"), 0644)
+	os.WriteFile(filepath.Join(src, "assets", "run.sh"), []byte("#!/bin/sh\n"), 0750)
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chtimes(filepath.Join(src, "index.html"), mtime, mtime)
+
+	// Copy into an existing "remote" directory, then back again
+	remote := t.TempDir()
+	if err := upload(context.Background(), sc, src, remote, copyOptions{Recursive: true, Preserve: true}); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	script := filepath.Join(remote, "site", "assets", "run.sh")
+	if info, err := os.Stat(script); err != nil || info.Mode().Perm() != 0750 {
+		t.Errorf("expected %s with mode 0750, got %v, %v", script, info, err)
+	}
+	if info, err := os.Stat(filepath.Join(remote, "site", "index.html")); err != nil || !info.ModTime().Equal(mtime) {
+		t.Errorf("expected preserved mtime %s, got %v, %v", mtime, info, err)
+	}
+
+	local := filepath.Join(t.TempDir(), "copy")
+	if err := download(context.Background(), sc, filepath.Join(remote, "site"), local, copyOptions{Recursive: true}); err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(local, "index.html"))
+	if err != nil || string(data) != "<h1>hi</h1>" {
+		t.Errorf("expected downloaded index.html, got %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(local, "assets", "run.sh")); err != nil {
+		t.Errorf("expected downloaded subdirectory: %v", err)
+	}
+}
+
+// statWriter records the mode of a file each time progress is drawn.
+type statWriter struct {
+	path  string
+	modes []os.FileMode
+}
+
+func (w *statWriter) Write(b []byte) (int, error) {
+	if info, err := os.Stat(w.path); err == nil {
+		w.modes = append(w.modes, info.Mode().Perm())
+	}
+	return len(b), nil
+}
+
+func TestUploadModeBeforeWrite(t *testing.T) {
+	sc := newTestSFTP(t)
+
+	src := filepath.Join(t.TempDir(), "secret.env")
+	os.WriteFile(src, []byte("TOKEN=abc\n"), 0644)
+	dst := filepath.Join(t.TempDir(), "secret.env")
+	os.WriteFile(dst, []byte("old\n"), 0644)
+
+	// Progress is drawn after the first read, before anything is written
+	w := &statWriter{path: dst}
+	if err := upload(context.Background(), sc, src, dst, copyOptions{Mode: 0600, Progress: w}); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	if len(w.modes) == 0 || w.modes[0] != 0600 {
+		t.Errorf("expected mode 0600 before writing, got %v", w.modes)
+	}
+	if info, err := os.Stat(dst); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected %s with mode 0600, got %v, %v", dst, info, err)
+	}
+}
+
+func TestUploadInterrupted(t *testing.T) {
+	sc := newTestSFTP(t)
+
+	src := filepath.Join(t.TempDir(), "app.tar.gz")
+	os.WriteFile(src, []byte("data"), 0644)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := upload(ctx, sc, src, t.TempDir(), copyOptions{}); !errors.Is(err, errInterrupted) {
+		t.Errorf("expected interrupted upload, got %v", err)
+	}
+}
+
+func TestUploadDirectoryNeedsRecursive(t *testing.T) {
+	sc := newTestSFTP(t)
+	if err := upload(context.Background(), sc, t.TempDir(), t.TempDir(), copyOptions{}); err == nil {
+		t.Error("expected error when copying a directory without -r")
+	}
+}
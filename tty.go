@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// startTTY requests a pty matching the local terminal size, puts the
+// local terminal into raw mode and forwards stdin and window size changes
+// to the session. The returned function restores the local terminal and
+// must be called once the session has finished; once it returns, nothing
+// reads stdin any more, so later prompts get the keystrokes.
+func startTTY(session *ssh.Session) (func(), error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		printWarning("stdin is not a terminal, running without tty")
+		return func() {}, nil
+	}
+
+	width, height, err := term.GetSize(fd)
+	if err != nil {
+		width, height = 80, 24
+	}
+	termType := os.Getenv("TERM")
+	if termType == "" {
+		termType = "xterm-256color"
+	}
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if err := session.RequestPty(termType, height, width, modes); err != nil {
+		return nil, err
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	stdin, err := newSessionStdin(os.Stdin)
+	if err != nil {
+		term.Restore(fd, state)
+		return nil, err
+	}
+	session.Stdin = stdin
+	stopResize := watchWindowSize(fd, session)
+
+	return func() {
+		stopResize()
+		stdin.Close()
+		term.Restore(fd, state)
+	}, nil
+}
@@ -0,0 +1,122 @@
+//go:build !windows
+
+package main
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+// watchWindowSize sends a window-change request to the session whenever
+// the local terminal is resized. The returned function stops watching.
+func watchWindowSize(fd int, session *ssh.Session) func() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGWINCH)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-sigs:
+				if width, height, err := term.GetSize(fd); err == nil {
+					session.WindowChange(height, width)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+// sessionStdin reads stdin for one tty session. Reads wait in poll on
+// stdin and a wakeup pipe, so Close can stop a pending read: after a
+// session ends, nothing is left reading stdin to swallow the answer to
+// the next host's prompt.
+type sessionStdin struct {
+	fd     int
+	wakeR  *os.File
+	wakeW  *os.File
+	wakeFd int
+
+	mu     sync.Mutex // held while a read is in progress
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newSessionStdin(f *os.File) (io.ReadCloser, error) {
+	wakeR, wakeW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	return &sessionStdin{
+		fd:     int(f.Fd()),
+		wakeR:  wakeR,
+		wakeW:  wakeW,
+		wakeFd: int(wakeR.Fd()),
+		closed: make(chan struct{}),
+	}, nil
+}
+
+func (r *sessionStdin) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for {
+		select {
+		case <-r.closed:
+			return 0, io.EOF
+		default:
+		}
+		fds := []unix.PollFd{
+			{Fd: int32(r.fd), Events: unix.POLLIN},
+			{Fd: int32(r.wakeFd), Events: unix.POLLIN},
+		}
+		if _, err := unix.Poll(fds, -1); err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return 0, err
+		}
+		if fds[1].Revents != 0 {
+			return 0, io.EOF
+		}
+		if fds[0].Revents == 0 {
+			continue
+		}
+		n, err := unix.Read(r.fd, p)
+		switch {
+		case err == unix.EINTR || err == unix.EAGAIN:
+			continue
+		case err != nil:
+			return 0, err
+		case n == 0:
+			return 0, io.EOF
+		}
+		return n, nil
+	}
+}
+
+// Close stops a pending read and waits for it to return.
+func (r *sessionStdin) Close() error {
+	r.once.Do(func() {
+		close(r.closed)
+		r.wakeW.Write([]byte{0})
+		r.mu.Lock()
+		r.wakeR.Close()
+		r.wakeW.Close()
+		r.mu.Unlock()
+	})
+	return nil
+}
@@ -0,0 +1,52 @@
+//go:build !windows
+
+package main
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSessionStdinClose(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	stdin, err := newSessionStdin(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteString("ls\n")
+	buf := make([]byte, 16)
+	if n, err := stdin.Read(buf); err != nil || string(buf[:n]) != "ls\n" {
+		t.Fatalf("expected to read input, got %q, %v", buf[:n], err)
+	}
+
+	// A read waiting for input when the session ends
+	done := make(chan error, 1)
+	go func() {
+		_, err := stdin.Read(buf)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	stdin.Close()
+	select {
+	case err := <-done:
+		if err != io.EOF {
+			t.Errorf("expected EOF after Close, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read still pending after Close")
+	}
+
+	// What's typed next, e.g. a passphrase, is left for the next reader
+	w.WriteString("secret\n")
+	if n, err := r.Read(buf); err != nil || string(buf[:n]) != "secret\n" {
+		t.Errorf("expected input after Close to be left unread, got %q, %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,74 @@
+//go:build windows
+
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// watchWindowSize is a no-op on Windows, which has no SIGWINCH.
+func watchWindowSize(fd int, session *ssh.Session) func() {
+	return func() {}
+}
+
+// stdinPump reads stdin from a single goroutine for the whole run.
+// Console reads can't be interrupted, and handing stdin to each session
+// directly would leave a blocked reader behind after every session.
+var stdinPump struct {
+	once sync.Once
+	ch   chan []byte
+}
+
+// sessionStdin is a session's view of the shared stdin pump. It returns
+// io.EOF once closed, so the session's copy goroutine exits.
+type sessionStdin struct {
+	done    chan struct{}
+	once    sync.Once
+	pending []byte
+}
+
+func newSessionStdin(f *os.File) (io.ReadCloser, error) {
+	stdinPump.once.Do(func() {
+		stdinPump.ch = make(chan []byte)
+		go func() {
+			defer close(stdinPump.ch)
+			for {
+				buf := make([]byte, 4096)
+				n, err := f.Read(buf)
+				if n > 0 {
+					stdinPump.ch <- buf[:n]
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	})
+	return &sessionStdin{done: make(chan struct{})}, nil
+}
+
+func (r *sessionStdin) Read(p []byte) (int, error) {
+	if len(r.pending) == 0 {
+		select {
+		case buf, ok := <-stdinPump.ch:
+			if !ok {
+				return 0, io.EOF
+			}
+			r.pending = buf
+		case <-r.done:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *sessionStdin) Close() error {
+	r.once.Do(func() { close(r.done) })
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// forward is a parsed -L or -R spec: connections accepted on listen are
+// relayed to target. For -L the listener is local and the target is
+// dialed from the remote host; for -R it is the other way round.
+type forward struct {
+	listen string
+	target string
+}
+
+func (f forward) String() string {
+	return f.listen + " -> " + f.target
+}
+
+// parseForward parses a forwarding spec as used by ssh -L and -R:
+// [bind_address:]port:host:hostport. IPv6 addresses go in brackets. The
+// bind address defaults to localhost.
+func parseForward(spec string) (forward, error) {
+	parts, err := splitForward(spec)
+	if err != nil {
+		return forward{}, fmt.Errorf("invalid forward %q: %w", spec, err)
+	}
+
+	bind := "localhost"
+	switch len(parts) {
+	case 3:
+	case 4:
+		bind, parts = parts[0], parts[1:]
+	default:
+		return forward{}, fmt.Errorf("invalid forward %q: expected [bind_address:]port:host:hostport", spec)
+	}
+	for _, port := range []string{parts[0], parts[2]} {
+		if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+			return forward{}, fmt.Errorf("invalid forward %q: bad port %q", spec, port)
+		}
+	}
+	if parts[1] == "" {
+		return forward{}, fmt.Errorf("invalid forward %q: missing target host", spec)
+	}
+
+	return forward{
+		listen: net.JoinHostPort(bind, parts[0]),
+		target: net.JoinHostPort(parts[1], parts[2]),
+	}, nil
+}
+
+// splitForward splits spec at colons outside of brackets and strips the
+// brackets.
+func splitForward(spec string) ([]string, error) {
+	var parts []string
+	for spec != "" {
+		if spec[0] == '[' {
+			end := strings.IndexByte(spec, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("missing ]")
+			}
+			parts = append(parts, spec[1:end])
+			spec = spec[end+1:]
+			if spec != "" && spec[0] != ':' {
+				return nil, fmt.Errorf("expected : after ]")
+			}
+			spec = strings.TrimPrefix(spec, ":")
+			continue
+		}
+		part, rest, found := strings.Cut(spec, ":")
+		parts = append(parts, part)
+		spec = rest
+		if found && rest == "" {
+			parts = append(parts, "")
+		}
+	}
+	return parts, nil
+}
+
+// dialer opens the target side of a forwarded connection.
+type dialer func(network, addr string) (net.Conn, error)
+
+// serveForward relays each connection accepted on ln to f.target until
+// ctx is done.
+func serveForward(ctx context.Context, ln net.Listener, f forward, dial dialer) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			target, err := dial("tcp", f.target)
+			if err != nil {
+				printWarning("Forward %s: %v", f, err)
+				return
+			}
+			defer target.Close()
+			relay(conn, target)
+		}()
+	}
+}
+
+// relay copies data in both directions until either side is done.
+func relay(a, b net.Conn) {
+	var wg sync.WaitGroup
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		// Signal EOF to the other side if it supports half-close
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	wg.Go(func() { pipe(a, b) })
+	wg.Go(func() { pipe(b, a) })
+	wg.Wait()
+}
+
+// runTunnel starts the local and remote forwards on client and keeps them
+// up until ctx is done or the connection drops.
+func runTunnel(ctx context.Context, client *SSHClient, hostName string, local, remote []forward) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	go func() {
+		client.client.Wait()
+		cancel(fmt.Errorf("connection to %s closed", hostName))
+	}()
+
+	var wg sync.WaitGroup
+	serve := func(kind string, ln net.Listener, f forward, dial dialer) {
+		printSuccess("%s forward %s via %s", kind, f, hostName)
+		wg.Go(func() {
+			if err := serveForward(ctx, ln, f, dial); err != nil {
+				cancel(fmt.Errorf("%s forward %s via %s: %w", strings.ToLower(kind), f, hostName, err))
+			}
+		})
+	}
+
+	// A forward that can't listen, e.g. on a port in use, stops the tunnel
+	for _, f := range local {
+		ln, err := net.Listen("tcp", f.listen)
+		if err != nil {
+			cancel(nil)
+			wg.Wait()
+			return fmt.Errorf("local forward %s: %w", f, err)
+		}
+		serve("Local", ln, f, client.client.Dial)
+	}
+	for _, f := range remote {
+		ln, err := client.client.Listen("tcp", f.listen)
+		if err != nil {
+			cancel(nil)
+			wg.Wait()
+			return fmt.Errorf("remote forward %s on %s: %w", f, hostName, err)
+		}
+		serve("Remote", ln, f, net.Dial)
+	}
+
+	<-ctx.Done()
+	wg.Wait()
+	if err := context.Cause(ctx); err != context.Canceled {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		spec   string
+		listen string
+		target string
+	}{
+		{"5432:localhost:5432", "localhost:5432", "localhost:5432"},
+		{"0.0.0.0:8080:admin.internal:80", "0.0.0.0:8080", "admin.internal:80"},
+		{"[::1]:8080:[fd00::2]:80", "[::1]:8080", "[fd00::2]:80"},
+		{"8080:[fd00::2]:80", "localhost:8080", "[fd00::2]:80"},
+	}
+	for _, tt := range tests {
+		f, err := parseForward(tt.spec)
+		if err != nil {
+			t.Errorf("parseForward(%q): %v", tt.spec, err)
+			continue
+		}
+		if f.listen != tt.listen || f.target != tt.target {
+			t.Errorf("parseForward(%q) = %s, want %s -> %s", tt.spec, f, tt.listen, tt.target)
+		}
+	}
+
+	for _, spec := range []string{"5432", "5432:localhost", "a:localhost:5432", "5432::5432", "[::1:80:host:80", "1:2:3:4:5"} {
+		if _, err := parseForward(spec); err == nil {
+			t.Errorf("parseForward(%q): expected error", spec)
+		}
+	}
+}
+
+func TestTunnelValidate(t *testing.T) {
+	if err := (Tunnel{Host: "db", Local: []string{"5432:localhost:5432"}}).Validate("pg"); err != nil {
+		t.Errorf("expected valid tunnel, got %v", err)
+	}
+	if err := (Tunnel{Local: []string{"5432:localhost:5432"}}).Validate("pg"); err == nil {
+		t.Error("expected error for missing host")
+	}
+	if err := (Tunnel{Host: "db"}).Validate("pg"); err == nil {
+		t.Error("expected error for missing forwards")
+	}
+	if err := (Tunnel{Host: "db", Remote: []string{"bogus"}}).Validate("pg"); err == nil {
+		t.Error("expected error for invalid forward")
+	}
+}